@@ -0,0 +1,264 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// A batch of events from the spooler, published in load balance mode.
+type balancedBatch struct {
+	index    int // order the batch was spooled in
+	events   []*FileEvent
+	acked    int // how many of events have been acknowledged
+	released int // how many of events have been passed to the registrar
+}
+
+// The events of the batch still to be acknowledged.
+func (b *balancedBatch) unacked() []*FileEvent {
+	return b.events[b.acked:]
+}
+
+type byIndex []*balancedBatch
+
+func (b byIndex) Len() int           { return len(b) }
+func (b byIndex) Less(i, j int) bool { return b[i].index < b[j].index }
+func (b byIndex) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// A server events are published to in load balance mode, with its own
+// connection.
+type balancedServer struct {
+	*server
+	input    chan []*FileEvent
+	up       bool
+	assigned []*balancedBatch // batches sent to the server, in order
+}
+
+// The number of events sent to the server that it has not acknowledged.
+func (s *balancedServer) pending() (n int) {
+	for _, b := range s.assigned {
+		n += len(b.events) - b.acked
+	}
+	return n
+}
+
+// What a server tells the publisher: that it connected, that it
+// acknowledged some events, or that its connection failed.
+type serverReport struct {
+	server    *balancedServer
+	connected bool
+	events    []*FileEvent
+	err       error
+}
+
+// Keep a connection open to hostport, publishing the events received on
+// input, until input is closed. While the server is down, gives up once quit
+// is closed.
+func (s *balancedServer) run(material *tlsMaterial,
+	backoff *BackoffConfig,
+	reports chan *serverReport,
+	quit chan struct{},
+	config *NetworkConfig) {
+	var sequence uint32
+
+	report := func(r *serverReport) {
+		select {
+		case reports <- r:
+		case <-quit:
+		}
+	}
+	wait := func(delay time.Duration) bool {
+		select {
+		case <-time.After(delay):
+			return true
+		case <-quit:
+			return false
+		}
+	}
+
+	for {
+		socket, err := dial(s.hostport, material, config)
+		if err != nil {
+			delay := s.failed(backoff)
+			emit("Backing off from %s for %v\n", s.hostport, delay)
+			if !wait(delay) {
+				return
+			}
+			continue
+		}
+		s.connected = time.Now()
+		report(&serverReport{server: s, connected: true})
+
+		// Forward acknowledged events as reports, finishing before the
+		// connection failure is reported so they are not sent again
+		acked := make(chan []*FileEvent)
+		forwarded := make(chan struct{})
+		go func() {
+			for events := range acked {
+				report(&serverReport{server: s, events: events})
+			}
+			close(forwarded)
+		}()
+
+		_, err = pipeline(socket, s.input, acked, nil, &sequence, config)
+		socket.Close()
+		close(acked)
+		<-forwarded
+		if err == nil {
+			return
+		}
+
+		delay := s.failed(backoff)
+		emit("Socket error with %s, will reconnect in %v: %s\n", s.hostport, delay, err)
+		report(&serverReport{server: s, err: err})
+		if !wait(delay) {
+			return
+		}
+	}
+}
+
+// PublishBalanced keeps a connection open to every server and spreads the
+// batches from the spooler across the connected servers of the highest
+// priority, either in turn ("round-robin") or to the server with the fewest
+// events waiting to be acknowledged ("least-pending"). When a connection
+// fails, the events it had not acknowledged are sent to another server. The
+// registrar is told about events strictly in the order they were spooled.
+//
+// Once the publisher is replaced by one for a new network config, it gives up
+// as soon as no server is connected, and returns what it has not published.
+func PublishBalanced(input chan []*FileEvent,
+	registrar chan []*FileEvent,
+	config *NetworkConfig) [][]*FileEvent {
+	material := tlsMaterialFor(config)
+	backoff := reconnectBackoff(config)
+	reports := make(chan *serverReport)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	var servers []*balancedServer
+	for _, configured := range configuredServers(config) {
+		s := &balancedServer{server: configured, input: make(chan []*FileEvent)}
+		servers = append(servers, s)
+		go s.run(material, backoff, reports, quit, config)
+	}
+	stopping := config.stop
+
+	var batches []*balancedBatch // batches not yet passed to the registrar
+	var queue []*balancedBatch   // batches waiting to be sent to a server
+	var spooled int
+	var rotation int
+
+	for {
+		// Pass acknowledged events to the registrar in order
+		for len(batches) != 0 {
+			b := batches[0]
+			if b.acked > b.released {
+				registrar <- b.events[b.released:b.acked]
+				b.released = b.acked
+			}
+			if b.released != len(b.events) {
+				break
+			}
+			batches = batches[1:]
+		}
+
+		if input == nil && len(batches) == 0 {
+			for _, s := range servers {
+				close(s.input)
+			}
+			return nil
+		}
+
+		if stopping == nil && replaced(config) && pickServer(servers, 0, config.LoadBalance) == -1 {
+			for _, s := range servers {
+				close(s.input)
+			}
+			var unsent [][]*FileEvent
+			for _, b := range batches {
+				unsent = append(unsent, b.events[b.released:])
+			}
+			return unpublished(input, unsent...)
+		}
+
+		// Take a batch from the spooler, or send the first waiting batch,
+		// once there is a server to send it to
+		var next, send chan []*FileEvent
+		var unacked []*FileEvent
+		target := pickServer(servers, rotation, config.LoadBalance)
+		if target != -1 {
+			if len(queue) == 0 {
+				next = input
+			} else {
+				send = servers[target].input
+				unacked = queue[0].unacked()
+			}
+		}
+
+		select {
+		case events, ok := <-next:
+			if !ok {
+				input = nil
+				continue
+			}
+			b := &balancedBatch{index: spooled, events: events}
+			spooled++
+			batches = append(batches, b)
+			queue = append(queue, b)
+		case send <- unacked:
+			s := servers[target]
+			s.assigned = append(s.assigned, queue[0])
+			queue = queue[1:]
+			rotation = target + 1
+		case <-stopping:
+			// Check whether any server is connected to finish with
+			stopping = nil
+		case report := <-reports:
+			s := report.server
+			switch {
+			case report.connected:
+				s.up = true
+			case report.err != nil:
+				// Send whatever the server had not acknowledged elsewhere
+				s.up = false
+				queue = append(queue, s.assigned...)
+				sort.Sort(byIndex(queue))
+				s.assigned = nil
+			default:
+				// Servers acknowledge events in the order they were sent
+				b := s.assigned[0]
+				b.acked += len(report.events)
+				if b.acked == len(b.events) {
+					s.assigned = s.assigned[1:]
+				}
+			}
+		}
+	}
+} // PublishBalanced
+
+// Pick the server to send the next batch to, from the connected servers of
+// the highest priority, starting the search at rotation so servers take
+// turns. Returns -1 if no server is connected.
+func pickServer(servers []*balancedServer, rotation int, mode string) int {
+	var priority int
+	var connected bool
+	for _, s := range servers {
+		if s.up && (!connected || s.priority < priority) {
+			priority = s.priority
+			connected = true
+		}
+	}
+
+	best := -1
+	for i := range servers {
+		candidate := (rotation + i) % len(servers)
+		if !servers[candidate].up || servers[candidate].priority != priority {
+			continue
+		}
+		if mode == "round-robin" {
+			return candidate
+		}
+		if best == -1 || servers[candidate].pending() < servers[best].pending() {
+			best = candidate
+		}
+	}
+	return best
+}
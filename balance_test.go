@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPickServer(t *testing.T) {
+	servers := []*balancedServer{
+		{server: &server{}, up: true, assigned: []*balancedBatch{{events: makeEvents("one", "two")}}},
+		{server: &server{}, up: false},
+		{server: &server{}, up: true, assigned: []*balancedBatch{{events: makeEvents("three")}}},
+		{server: &server{priority: 1}, up: true},
+	}
+
+	if picked := pickServer(servers, 1, "round-robin"); picked != 2 {
+		t.Errorf("Expected round-robin to skip the server that is down, picked %d", picked)
+	}
+	if picked := pickServer(servers, 0, "least-pending"); picked != 2 {
+		t.Errorf("Expected least-pending to pick the server with 1 pending event, picked %d", picked)
+	}
+	if picked := pickServer(servers, 3, "round-robin"); picked != 0 {
+		t.Errorf("Expected the server of lower priority to be skipped, picked %d", picked)
+	}
+
+	servers[0].up, servers[2].up = false, false
+	if picked := pickServer(servers, 0, "round-robin"); picked != 3 {
+		t.Errorf("Expected the server of lower priority once the others are down, picked %d", picked)
+	}
+	servers[3].up = false
+	if picked := pickServer(servers, 0, "round-robin"); picked != -1 {
+		t.Errorf("Expected no server to be picked when all are down, picked %d", picked)
+	}
+}
+
+// Serve protocol version 2 over TLS on a local port, with a certificate for
+// hostname, until the returned func is called.
+func listenv2(hostname string, handle func(net.Conn)) (address string, stop func()) {
+	config := &tls.Config{Certificates: []tls.Certificate{makeCert(hostname)}}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestPublishBalanced(t *testing.T) {
+	caCertFile, _ := ioutil.TempFile("", "logstash-forwarder-cacert")
+	defer os.Remove(caCertFile.Name())
+	ioutil.WriteFile(caCertFile.Name(), []byte(caCert), 0600)
+
+	// One server acknowledges everything, the other fails every window
+	good, stop := listenv2("127.0.0.1", func(conn net.Conn) {
+		for {
+			frames, err := readWindowv2(conn)
+			if err != nil {
+				return
+			}
+			writeAckv2(conn, frames[len(frames)-1].sequence)
+		}
+	})
+	defer stop()
+	bad, stop := listenv2("127.0.0.1", func(conn net.Conn) {
+		readWindowv2(conn)
+	})
+	defer stop()
+
+	config := &NetworkConfig{
+		Servers:         []string{good, bad},
+		SSLCA:           caCertFile.Name(),
+		Protocol:        2,
+		WindowsInFlight: 1,
+		LoadBalance:     "round-robin",
+		timeout:         5 * time.Second,
+	}
+
+	var spooled []*FileEvent
+	input := make(chan []*FileEvent, 6)
+	for i := 0; i < cap(input); i++ {
+		batch := makeEvents("one", "", "two")
+		spooled = append(spooled, batch...)
+		input <- batch
+	}
+	close(input)
+
+	registrar := make(chan []*FileEvent, 1)
+	go func() {
+		PublishBalanced(input, registrar, config)
+		close(registrar)
+	}()
+
+	var published []*FileEvent
+	timeout := time.After(30 * time.Second)
+	for done := false; !done; {
+		select {
+		case events, ok := <-registrar:
+			published = append(published, events...)
+			done = !ok
+		case <-timeout:
+			t.Fatalf("Timed out with %d of %d events published", len(published), len(spooled))
+		}
+	}
+
+	// Every event reaches the registrar, in order
+	if len(published) != len(spooled) {
+		t.Fatalf("Expected %d events to be published, got %d", len(spooled), len(published))
+	}
+	for i := range spooled {
+		if published[i] != spooled[i] {
+			t.Fatalf("Event %d was passed to the registrar out of order", i)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate, key and CA files are checked for changes.
+const tlsReloadInterval = 10 * time.Second
+
+// The client certificate and trusted CAs used for TLS connections. They are
+// loaded again when their files change, all together, so a connection never
+// mixes old and new material. If the new files fail to load, for example
+// because they are only partly written, the last good material stays in use.
+type tlsMaterial struct {
+	config *NetworkConfig
+
+	mutex       sync.Mutex
+	loaded      bool
+	certificate *tls.Certificate
+	roots       *x509.CertPool
+	stamp       string // the state of the files when they were last loaded
+}
+
+// Return the TLS material for config, loading it and starting to watch its
+// files the first time. Returns nil if TLS is not used.
+func tlsMaterialFor(config *NetworkConfig) *tlsMaterial {
+	if config.Transport == "tcp" {
+		return nil
+	}
+	if config.material == nil {
+		config.material = &tlsMaterial{config: config}
+		if err := config.material.reload(); err != nil {
+			emit("Failed loading TLS material, will try again: %s\n", err)
+		}
+		go config.material.watch()
+	}
+	return config.material
+}
+
+// Load the material again whenever its files change, until the publisher
+// using it is replaced.
+func (m *tlsMaterial) watch() {
+	for {
+		select {
+		case <-time.After(tlsReloadInterval):
+		case <-m.config.stop:
+			return
+		}
+		if err := m.reload(); err != nil {
+			emit("Failed reloading TLS material, keeping what was loaded before: %s\n", err)
+		}
+	}
+}
+
+// Describe the size and modification time of every file the material is
+// loaded from, to tell when any of them changes.
+func (m *tlsMaterial) fileStamp() string {
+	var files []string
+	if m.config.SSLCertificate != "" && m.config.SSLKey != "" {
+		files = append(files, m.config.SSLCertificate, m.config.SSLKey)
+	}
+	if m.config.SSLCA != "" && !m.config.SSLPinOnly {
+		files = append(files, m.config.SSLCA)
+		if entries, err := ioutil.ReadDir(m.config.SSLCA); err == nil {
+			for _, entry := range entries {
+				files = append(files, filepath.Join(m.config.SSLCA, entry.Name()))
+			}
+		}
+	}
+
+	var stamp bytes.Buffer
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil {
+			fmt.Fprintf(&stamp, "%s: %s\n", file, err)
+		} else {
+			fmt.Fprintf(&stamp, "%s: %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return stamp.String()
+}
+
+// Load the material again if any of its files changed since the last
+// attempt.
+func (m *tlsMaterial) reload() error {
+	stamp := m.fileStamp()
+	m.mutex.Lock()
+	unchanged := stamp == m.stamp && m.stamp != ""
+	m.mutex.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, roots, err := loadTLSMaterial(m.config)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Don't try the same files again until they change
+	m.stamp = stamp
+	if err != nil {
+		tlsMetrics.Add("reload failures", 1)
+		tlsLastError.Set(err.Error())
+		return err
+	}
+	if m.loaded {
+		emit("Reloaded TLS material\n")
+	}
+	m.certificate, m.roots, m.loaded = certificate, roots, true
+	tlsMetrics.Add("reloads", 1)
+	tlsLastReload.Set(time.Now().Format(time.RFC3339))
+	tlsLastError.Set("")
+	return nil
+}
+
+func loadTLSMaterial(config *NetworkConfig) (certificate *tls.Certificate, roots *x509.CertPool, err error) {
+	if len(config.SSLCertificate) > 0 && len(config.SSLKey) > 0 {
+		emit("Loading client ssl certificate: %s and %s\n",
+			config.SSLCertificate, config.SSLKey)
+		cert, err := tls.LoadX509KeyPair(config.SSLCertificate, config.SSLKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed loading client ssl certificate: %s", err)
+		}
+		certificate = &cert
+	}
+
+	if config.SSLPinOnly {
+		emit("Trusting servers by ssl pins only\n")
+	} else if len(config.SSLCA) > 0 || config.SSLSystemRoots {
+		if roots, err = loadCertPool(config); err != nil {
+			return nil, nil, err
+		}
+	}
+	return certificate, roots, nil
+}
+
+// Return the TLS config to connect to the server named host with, using the
+// material loaded last.
+func (m *tlsMaterial) clientConfig(host string) (*tls.Config, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.loaded {
+		return nil, errors.New("no TLS material has loaded successfully yet")
+	}
+
+	tlsconfig := &tls.Config{
+		RootCAs:    m.roots,
+		ServerName: host,
+	}
+	if m.config.SSLServerName != "" {
+		tlsconfig.ServerName = m.config.SSLServerName
+	}
+	// The options were checked when the config was loaded
+	tlsconfig.MinVersion, tlsconfig.MaxVersion, tlsconfig.CipherSuites, tlsconfig.CurvePreferences, _ = tlsOptions(m.config)
+	if m.certificate != nil {
+		tlsconfig.Certificates = []tls.Certificate{*m.certificate}
+	}
+	if m.config.SSLPinOnly {
+		// Servers are checked against ssl pins after the handshake instead
+		tlsconfig.InsecureSkipVerify = true
+	}
+	return tlsconfig, nil
+}
+
+// Build the pool of CAs trusted to sign server certificates: the system
+// roots if asked for, and every certificate in the "ssl ca" file, or in the
+// files of the "ssl ca" directory.
+func loadCertPool(config *NetworkConfig) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if config.SSLSystemRoots {
+		emit("Trusting the system root CAs\n")
+		system, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("Failure loading system root CAs: %s", err)
+		}
+		pool = system
+	}
+	if config.SSLCA == "" {
+		return pool, nil
+	}
+
+	info, err := os.Stat(config.SSLCA)
+	if err != nil {
+		return nil, fmt.Errorf("Failure reading CA certificates: %s", err)
+	}
+
+	files := []string{config.SSLCA}
+	if !info.IsDir() {
+		emit("Setting trusted CA from file: %s\n", config.SSLCA)
+	} else {
+		emit("Setting trusted CA from files in: %s\n", config.SSLCA)
+		entries, err := ioutil.ReadDir(config.SSLCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failure reading CA directory: %s", err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			// Follow links, as CA directories are often made of them
+			path := filepath.Join(config.SSLCA, entry.Name())
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				files = append(files, path)
+			}
+		}
+	}
+
+	loaded := 0
+	for _, file := range files {
+		n, err := addCertificates(pool, file)
+		if err != nil {
+			return nil, err
+		}
+		loaded += n
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("No CA certificates found in %s", config.SSLCA)
+	}
+	return pool, nil
+}
+
+// Add every certificate in the PEM file at path to pool, returning how many
+// were added. Blocks that are not valid certificates are reported and
+// skipped, so one bad block does not stop the rest of a bundle being trusted.
+func addCertificates(pool *x509.CertPool, path string) (int, error) {
+	pemdata, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("Failure reading CA certificate: %s", err)
+	}
+
+	loaded := 0
+	rest := pemdata
+	for index := 1; ; index++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			emit("Rejected PEM block %d in %s: a %s is not a certificate\n", index, path, block.Type)
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			emit("Rejected PEM block %d in %s: %s\n", index, path, err)
+			continue
+		}
+		pool.AddCert(cert)
+		loaded++
+		emit("Trusting CA certificate %q from %s\n", cert.Subject.CommonName, path)
+	}
+
+	if len(bytes.TrimSpace(rest)) != 0 {
+		if len(rest) == len(pemdata) {
+			emit("Rejected %s: no PEM data found, is it a valid cert?\n", path)
+		} else {
+			emit("Rejected the end of %s: it is not PEM data\n", path)
+		}
+	}
+	return loaded, nil
+}
+
+// Decode a public key pin: the base64 SHA-256 digest of the DER encoded
+// SubjectPublicKeyInfo of a certificate, optionally prefixed by "sha256/".
+func parsePin(pin string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("ssl pin %q is not a base64 SHA-256 digest", pin)
+	}
+	return digest, nil
+}
+
+func certificatePin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// Check that the public key of a certificate the server presented is pinned,
+// when pins are configured. Any certificate of a verified chain may match,
+// but not the other certificates the server sent along, which nothing
+// checked. When only pins are checked no chain is verified, so only the
+// leaf's key, which the server proved it holds, can be trusted.
+func checkPins(state tls.ConnectionState, config *NetworkConfig) error {
+	if len(config.SSLPins) == 0 {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("the server presented no certificate to check against ssl pins")
+	}
+
+	pinned := make(map[string]bool, len(config.SSLPins))
+	for _, pin := range config.SSLPins {
+		digest, _ := parsePin(pin)
+		pinned[string(digest)] = true
+	}
+
+	candidates := state.PeerCertificates[:1]
+	if !config.SSLPinOnly {
+		candidates = nil
+		for _, chain := range state.VerifiedChains {
+			candidates = append(candidates, chain...)
+		}
+	}
+	for _, cert := range candidates {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pinned[string(digest[:])] {
+			return nil
+		}
+	}
+	return fmt.Errorf("no key of the server certificates is in ssl pins, its own key is %s", certificatePin(state.PeerCertificates[0]))
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// Parse the TLS versions, cipher suites and curves of config.
+func tlsOptions(config *NetworkConfig) (min uint16, max uint16, suites []uint16, curves []tls.CurveID, err error) {
+	min, max = tls.VersionTLS10, 0
+	if config.SSLMinVersion != "" {
+		if min = tlsVersions[config.SSLMinVersion]; min == 0 {
+			return 0, 0, nil, nil, fmt.Errorf("ssl min version must be 1.0, 1.1, 1.2 or 1.3, not '%s'", config.SSLMinVersion)
+		}
+	}
+	if config.SSLMaxVersion != "" {
+		if max = tlsVersions[config.SSLMaxVersion]; max == 0 {
+			return 0, 0, nil, nil, fmt.Errorf("ssl max version must be 1.0, 1.1, 1.2 or 1.3, not '%s'", config.SSLMaxVersion)
+		}
+		if max < min {
+			return 0, 0, nil, nil, fmt.Errorf("ssl max version (%s) is less than min version (%s)", config.SSLMaxVersion, config.SSLMinVersion)
+		}
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	for _, name := range config.SSLCipherSuites {
+		id, ok := known[name]
+		if !ok {
+			return 0, 0, nil, nil, fmt.Errorf("unknown ssl cipher suite '%s'", name)
+		}
+		suites = append(suites, id)
+	}
+
+	for _, name := range config.SSLCurves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return 0, 0, nil, nil, fmt.Errorf("ssl curves must be P256, P384, P521 or X25519, not '%s'", name)
+		}
+		curves = append(curves, id)
+	}
+	return min, max, suites, curves, nil
+}
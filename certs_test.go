@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadCertPoolBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-certs")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	// Two CAs, with a key and a broken certificate in between
+	otherCert, _ := makeCA()
+	bundle := caCert + caKey +
+		"-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n" +
+		otherCert + "trailing junk\n"
+	path := filepath.Join(dir, "bundle.pem")
+	chkerr(t, ioutil.WriteFile(path, []byte(bundle), 0644))
+
+	config := &NetworkConfig{SSLCA: path}
+	pool, err := loadCertPool(config)
+	chkerr(t, err)
+	if n := len(pool.Subjects()); n != 2 {
+		t.Fatalf("Expected both certificates in the bundle to be trusted, got %d", n)
+	}
+}
+
+func TestLoadCertPoolDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-certs")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	otherCert, _ := makeCA()
+	chkerr(t, ioutil.WriteFile(filepath.Join(dir, "a.pem"), []byte(caCert), 0644))
+	chkerr(t, ioutil.WriteFile(filepath.Join(dir, "b.crt"), []byte(otherCert), 0644))
+	chkerr(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a cert\n"), 0644))
+	chkerr(t, os.Mkdir(filepath.Join(dir, "old"), 0755))
+
+	pool, err := loadCertPool(&NetworkConfig{SSLCA: dir})
+	chkerr(t, err)
+	if n := len(pool.Subjects()); n != 2 {
+		t.Fatalf("Expected the certificates of both files to be trusted, got %d", n)
+	}
+
+	// Nothing to trust is an error
+	empty := filepath.Join(dir, "old")
+	if _, err := loadCertPool(&NetworkConfig{SSLCA: empty}); err == nil {
+		t.Errorf("Expected an error for a directory without certificates")
+	}
+}
+
+func TestCheckPins(t *testing.T) {
+	leaf, err := x509.ParseCertificate(makeCert("localhost").Certificate[0])
+	chkerr(t, err)
+	block, _ := pem.Decode([]byte(caCert))
+	ca, err := x509.ParseCertificate(block.Bytes)
+	chkerr(t, err)
+	state := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, ca}},
+	}
+
+	tests := []struct {
+		pins    []string
+		pinOnly bool
+		ok      bool
+	}{
+		{[]string{certificatePin(leaf)}, false, true},
+		{[]string{certificatePin(leaf)}, true, true},
+		// The CA is only trusted when the chain is verified
+		{[]string{certificatePin(ca)}, false, true},
+		{[]string{certificatePin(ca)}, true, false},
+		{[]string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}, false, false},
+	}
+	for _, test := range tests {
+		config := &NetworkConfig{SSLPins: test.pins, SSLPinOnly: test.pinOnly}
+		if err := checkPins(state, config); (err == nil) != test.ok {
+			t.Errorf("Expected pins %v (pin only %t) to pass: %t, got %v", test.pins, test.pinOnly, test.ok, err)
+		}
+	}
+}
+
+func TestHandshakeIgnoresUnverifiedPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-certs")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	// A server with a valid chain, and a pinned certificate it has no key for
+	// sent along after it
+	otherCert, _ := makeCA()
+	block, _ := pem.Decode([]byte(otherCert))
+	other, err := x509.ParseCertificate(block.Bytes)
+	chkerr(t, err)
+	cert := makeCert("localhost")
+	cert.Certificate = append(cert.Certificate, other.Raw)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		socket := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+		ioutil.ReadAll(socket)
+	}()
+
+	caCertFile := filepath.Join(dir, "ca.crt")
+	chkerr(t, ioutil.WriteFile(caCertFile, []byte(caCert), 0600))
+	config := &NetworkConfig{SSLCA: caCertFile, SSLPins: []string{certificatePin(other)}, timeout: 5 * time.Second}
+	m := &tlsMaterial{config: config}
+	chkerr(t, m.reload())
+
+	if socket, err := handshake(client, "localhost", m, config); err == nil {
+		socket.Close()
+		t.Fatalf("Expected a pin of a certificate outside the verified chain to be rejected")
+	}
+}
+
+func TestLoadNetworkConfigPins(t *testing.T) {
+	bad := []NetworkConfig{
+		{SSLPins: []string{"sha256/not base64"}},
+		{SSLPins: []string{"AAAA"}},
+		{SSLPinOnly: true},
+	}
+	for _, network := range bad {
+		if err := loadNetworkConfig(&network); err == nil {
+			t.Errorf("Expected an error loading %+v", network)
+		}
+	}
+}
+
+func TestTLSMaterialReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-certs")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &NetworkConfig{
+		SSLCertificate: filepath.Join(dir, "client.crt"),
+		SSLKey:         filepath.Join(dir, "client.key"),
+	}
+	write := func(cert, key string) {
+		chkerr(t, ioutil.WriteFile(config.SSLCertificate, []byte(cert), 0600))
+		chkerr(t, ioutil.WriteFile(config.SSLKey, []byte(key), 0600))
+	}
+	clientCert := func(m *tlsMaterial) []byte {
+		tlsconfig, err := m.clientConfig("localhost")
+		chkerr(t, err)
+		return tlsconfig.Certificates[0].Certificate[0]
+	}
+
+	m := &tlsMaterial{config: config}
+	if _, err := m.clientConfig("localhost"); err == nil {
+		t.Fatalf("Expected no TLS config before the material loads")
+	}
+
+	write(caCert, caKey)
+	chkerr(t, m.reload())
+	first := clientCert(m)
+
+	// A key that is only partly written fails to load, and the last good
+	// material stays in use
+	failures := func() int64 {
+		if count, ok := tlsMetrics.Get("reload failures").(*expvar.Int); ok {
+			return count.Value()
+		}
+		return 0
+	}
+	before := failures()
+	write(caCert, caKey[:len(caKey)/2])
+	if err := m.reload(); err == nil {
+		t.Fatalf("Expected an error loading a truncated key")
+	}
+	if !bytes.Equal(clientCert(m), first) {
+		t.Errorf("Expected the last good certificate to stay in use")
+	}
+	if failures() != before+1 {
+		t.Errorf("Expected the failure to be counted in metrics")
+	}
+
+	renewedCert, renewedKey := makeCA()
+	write(renewedCert, renewedKey)
+	chkerr(t, m.reload())
+	if bytes.Equal(clientCert(m), first) {
+		t.Errorf("Expected the renewed certificate to be used")
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	config := &NetworkConfig{
+		SSLMinVersion:   "1.2",
+		SSLCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		SSLCurves:       []string{"X25519", "P256"},
+	}
+	min, max, suites, curves, err := tlsOptions(config)
+	chkerr(t, err)
+	if min != tls.VersionTLS12 || max != 0 {
+		t.Errorf("Expected TLS 1.2 or later, got %x to %x", min, max)
+	}
+	if len(suites) != 1 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites %v", suites)
+	}
+	if len(curves) != 2 || curves[0] != tls.X25519 {
+		t.Errorf("Unexpected curves %v", curves)
+	}
+
+	bad := []NetworkConfig{
+		{SSLMinVersion: "3.0"},
+		{SSLMinVersion: "1.2", SSLMaxVersion: "1.1"},
+		{SSLCipherSuites: []string{"TLS_RSA_WITH_NOTHING"}},
+		{SSLCurves: []string{"P128"}},
+	}
+	for _, network := range bad {
+		if err := loadNetworkConfig(&network); err == nil {
+			t.Errorf("Expected an error loading %+v", network)
+		}
+	}
+}
+
+func TestDialServerName(t *testing.T) {
+	address, stop := listenv2("logstash.internal", func(conn net.Conn) {
+		ioutil.ReadAll(conn)
+	})
+	defer stop()
+
+	caCertFile, _ := ioutil.TempFile("", "logstash-forwarder-cacert")
+	defer os.Remove(caCertFile.Name())
+	ioutil.WriteFile(caCertFile.Name(), []byte(caCert), 0600)
+
+	config := &NetworkConfig{SSLCA: caCertFile.Name(), SSLMinVersion: "1.2", timeout: 5 * time.Second}
+	m := &tlsMaterial{config: config}
+	chkerr(t, m.reload())
+
+	// The certificate is not for the address connected to
+	if socket, err := dial(address, m, config); err == nil {
+		socket.Close()
+		t.Fatalf("Expected the server certificate to be refused")
+	}
+
+	config.SSLServerName = "logstash.internal"
+	socket, err := dial(address, m, config)
+	chkerr(t, err)
+	defer socket.Close()
+	if state := socket.(*tls.Conn).ConnectionState(); state.ServerName != "logstash.internal" || state.Version < tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 or later to logstash.internal, got %x to %s", state.Version, state.ServerName)
+	}
+}
@@ -7,39 +7,225 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 )
 
 const configFileSizeLimit = 10 << 20
 
 var defaultConfig = &struct {
-	netTimeout   int64
-	fileDeadtime string
+	netTimeout        int64
+	netProtocol       int
+	netTransport      string
+	windowsInFlight   int
+	fileDeadtime      string
+	multilineMatch    string
+	multilineMaxLines int
+	multilineTimeout  string
+	jsonMessageKey    string
+	jsonErrorKey      string
+	maxLineBytes      int
+	scanFrequency     string
+	idleTimeout       string
+	backoffMin        string
+	backoffMax        string
+	backoffMultiplier float64
+	reconnectMin      string
+	reconnectMax      string
+	maxGlobDepth      int
+	queueSegmentSize  int64
+	queueMaxSize      int64
+	queueFsync        string
 }{
-	netTimeout:   15,
-	fileDeadtime: "24h",
+	netTimeout:        15,
+	netProtocol:       1,
+	netTransport:      "tls",
+	windowsInFlight:   1,
+	fileDeadtime:      "24h",
+	multilineMatch:    "after",
+	multilineMaxLines: 500,
+	multilineTimeout:  "5s",
+	jsonMessageKey:    "message",
+	jsonErrorKey:      "json_error",
+	maxLineBytes:      10 << 20,
+	scanFrequency:     "10s",
+	idleTimeout:       "10s",
+	backoffMin:        "1s",
+	backoffMax:        "1s",
+	backoffMultiplier: 2,
+	reconnectMin:      "1s",
+	reconnectMax:      "60s",
+	maxGlobDepth:      8,
+	queueSegmentSize:  16 << 20,
+	queueMaxSize:      1 << 30,
+	queueFsync:        "always",
 }
 
 type Config struct {
-	Network NetworkConfig `json:network`
-	Files   []FileConfig  `json:files`
+	Network NetworkConfig `json:"network"`
+	Files   []FileConfig  `json:"files"`
+	Queue   QueueConfig   `json:"queue"`
 }
 
 type NetworkConfig struct {
-	Servers        []string `json:servers`
+	Servers        []string `json:"servers"`
 	SSLCertificate string   `json:"ssl certificate"`
 	SSLKey         string   `json:"ssl key"`
 	SSLCA          string   `json:"ssl ca"`
-	Timeout        int64    `json:timeout`
-	timeout        time.Duration
+	SSLSystemRoots bool     `json:"ssl system roots"`
+	Timeout        int64    `json:"timeout"`
+	Protocol       int      `json:"protocol"`
+	Transport      string   `json:"transport"`
+
+	// SHA-256 digests of public keys, one of which the server must present
+	SSLPins    []string `json:"ssl pins"`
+	SSLPinOnly bool     `json:"ssl pin only"`
+
+	// TLS versions ("1.0" to "1.3"), cipher suites and curves to offer
+	SSLMinVersion   string   `json:"ssl min version"`
+	SSLMaxVersion   string   `json:"ssl max version"`
+	SSLCipherSuites []string `json:"ssl cipher suites"`
+	SSLCurves       []string `json:"ssl curves"`
+
+	// The name to verify the server certificate against, and send in SNI,
+	// rather than the host of the server address
+	SSLServerName string `json:"ssl server name"`
+
+	// Windows of events that may be sent before the first is acknowledged
+	WindowsInFlight int `json:"windows in flight"`
+
+	// Spread events across all servers: "round-robin" or "least-pending"
+	LoadBalance string `json:"load balance"`
+
+	// Servers only used when every server of a higher priority is down
+	ServerGroups []ServerGroup `json:"server groups"`
+
+	// How long to wait before connecting again to a server that failed
+	ReconnectBackoff *BackoffConfig `json:"reconnect backoff"`
+
+	servers  *serverPool
+	material *tlsMaterial
+
+	// Closed when a publisher for a new network config takes over, so this
+	// one stops trying to connect and hands back what it has not published
+	stop chan struct{}
+
+	timeout time.Duration
+}
+
+// A group of servers of the same priority. Servers in groups with a lower
+// priority number are used first, the "servers" list having priority 0.
+type ServerGroup struct {
+	Priority int      `json:"priority"`
+	Servers  []string `json:"servers"`
+}
+
+// QueueConfig describes the queue on disk that spooled events wait in until
+// they are acknowledged. There is no queue unless Path is set.
+type QueueConfig struct {
+	Path        string `json:"path"`
+	SegmentSize int64  `json:"segment size"`
+	MaxSize     int64  `json:"max size"`
+	// When to sync the queue to disk: "always", "segment" or "never"
+	Fsync string `json:"fsync"`
 }
 
 type FileConfig struct {
-	Paths    []string          `json:paths`
-	Fields   map[string]string `json:fields`
-	DeadTime string            `json:"dead time"`
-	deadtime time.Duration
+	Paths     []string          `json:"paths"`
+	Fields    map[string]string `json:"fields"`
+	DeadTime  string            `json:"dead time"`
+	Multiline *MultilineConfig  `json:"multiline"`
+	// Longer lines are truncated to this many bytes (excluding the EOL)
+	MaxLineBytes  int            `json:"max line bytes"`
+	Encoding      string         `json:"encoding"`
+	Discovery     string         `json:"discovery"`
+	ScanFrequency string         `json:"scan frequency"`
+	IdleTimeout   string         `json:"idle timeout"`
+	Backoff       *BackoffConfig `json:"harvester backoff"`
+	ExcludeFiles  []string       `json:"exclude files"`
+	MaxGlobDepth  int            `json:"max glob depth"`
+	IncludeLines  []string       `json:"include lines"`
+	DropLines     []string       `json:"drop lines"`
+	Gzip          bool           `json:"gzip"`
+	JSON          *JSONConfig    `json:"json"`
+	deadtime      time.Duration
+	codec         *codec
+	scanFrequency time.Duration
+	idleTimeout   time.Duration
+	excludeFiles  []*excludePattern
+	includeLines  []*regexp.Regexp
+	dropLines     []*regexp.Regexp
+}
+
+// MultilineConfig describes how continuation lines are joined onto the line
+// that precedes ("after") or follows ("before") them to form one event.
+type MultilineConfig struct {
+	Pattern  string `json:"pattern"`
+	Negate   bool   `json:"negate"`
+	Match    string `json:"match"`
+	MaxLines int    `json:"max lines"`
+	Timeout  string `json:"timeout"`
+	regexp   *regexp.Regexp
+	timeout  time.Duration
+}
+
+// JSONConfig describes how lines holding a JSON object are decoded, so its
+// keys are published individually.
+type JSONConfig struct {
+	// The key whose value is published as the "line"
+	MessageKey string `json:"message key"`
+	// Decoded keys replace "file", "host", "offset", "line" and the fields
+	// of the same name, instead of being dropped
+	OverwriteKeys bool `json:"overwrite keys"`
+	// The key that holds the error when a line can't be decoded
+	ErrorKey string `json:"error key"`
+}
+
+// BackoffConfig describes how long to wait before trying again, when a
+// harvester finds no more data at the end of a file, or a connection to a
+// server fails. The wait starts at Min and is multiplied by Multiplier, up to
+// Max, each time the attempt fails.
+type BackoffConfig struct {
+	Min        string  `json:"min"`
+	Max        string  `json:"max"`
+	Multiplier float64 `json:"multiplier"`
+	min        time.Duration
+	max        time.Duration
+}
+
+// An "exclude files" entry, either a /regexp/ matched anywhere in the path or
+// a shell glob matched against the whole path or the file name.
+type excludePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+func newExcludePattern(pattern string) (*excludePattern, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude files regexp '%s': %s", pattern, err)
+		}
+		return &excludePattern{regexp: re}, nil
+	}
+
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid exclude files glob '%s': %s", pattern, err)
+	}
+	return &excludePattern{glob: pattern}, nil
+}
+
+func (e *excludePattern) match(file string) bool {
+	if e.regexp != nil {
+		return e.regexp.MatchString(file)
+	}
+	if matched, _ := filepath.Match(e.glob, file); matched {
+		return true
+	}
+	matched, _ := filepath.Match(e.glob, filepath.Base(file))
+	return matched
 }
 
 func DiscoverConfigs(file_or_directory string) (files []string, err error) {
@@ -67,6 +253,7 @@ func DiscoverConfigs(file_or_directory string) (files []string, err error) {
 func MergeConfig(to *Config, from Config) (err error) {
 
 	to.Network.Servers = append(to.Network.Servers, from.Network.Servers...)
+	to.Network.ServerGroups = append(to.Network.ServerGroups, from.Network.ServerGroups...)
 	to.Files = append(to.Files, from.Files...)
 
 	// TODO: Is there a better way to do this in Go?
@@ -88,63 +275,349 @@ func MergeConfig(to *Config, from Config) (err error) {
 		}
 		to.Network.SSLCA = from.Network.SSLCA
 	}
+	if from.Network.SSLSystemRoots {
+		to.Network.SSLSystemRoots = true
+	}
+	to.Network.SSLPins = append(to.Network.SSLPins, from.Network.SSLPins...)
+	if from.Network.SSLPinOnly {
+		to.Network.SSLPinOnly = true
+	}
+	if from.Network.SSLMinVersion != "" {
+		if to.Network.SSLMinVersion != "" {
+			return fmt.Errorf("SSLMinVersion already defined as '%s' in previous config file", to.Network.SSLMinVersion)
+		}
+		to.Network.SSLMinVersion = from.Network.SSLMinVersion
+	}
+	if from.Network.SSLMaxVersion != "" {
+		if to.Network.SSLMaxVersion != "" {
+			return fmt.Errorf("SSLMaxVersion already defined as '%s' in previous config file", to.Network.SSLMaxVersion)
+		}
+		to.Network.SSLMaxVersion = from.Network.SSLMaxVersion
+	}
+	if len(from.Network.SSLCipherSuites) != 0 {
+		if len(to.Network.SSLCipherSuites) != 0 {
+			return fmt.Errorf("SSLCipherSuites already defined in previous config file")
+		}
+		to.Network.SSLCipherSuites = from.Network.SSLCipherSuites
+	}
+	if len(from.Network.SSLCurves) != 0 {
+		if len(to.Network.SSLCurves) != 0 {
+			return fmt.Errorf("SSLCurves already defined in previous config file")
+		}
+		to.Network.SSLCurves = from.Network.SSLCurves
+	}
+	if from.Network.SSLServerName != "" {
+		if to.Network.SSLServerName != "" {
+			return fmt.Errorf("SSLServerName already defined as '%s' in previous config file", to.Network.SSLServerName)
+		}
+		to.Network.SSLServerName = from.Network.SSLServerName
+	}
 	if from.Network.Timeout != 0 {
 		if to.Network.Timeout != 0 {
 			return fmt.Errorf("Timeout already defined as '%d' in previous config file", to.Network.Timeout)
 		}
 		to.Network.Timeout = from.Network.Timeout
 	}
+	if from.Network.Transport != "" {
+		if to.Network.Transport != "" {
+			return fmt.Errorf("Transport already defined as '%s' in previous config file", to.Network.Transport)
+		}
+		to.Network.Transport = from.Network.Transport
+	}
+	if from.Network.Protocol != 0 {
+		if to.Network.Protocol != 0 {
+			return fmt.Errorf("Protocol already defined as '%d' in previous config file", to.Network.Protocol)
+		}
+		to.Network.Protocol = from.Network.Protocol
+	}
+	if from.Network.WindowsInFlight != 0 {
+		if to.Network.WindowsInFlight != 0 {
+			return fmt.Errorf("WindowsInFlight already defined as '%d' in previous config file", to.Network.WindowsInFlight)
+		}
+		to.Network.WindowsInFlight = from.Network.WindowsInFlight
+	}
+	if from.Network.LoadBalance != "" {
+		if to.Network.LoadBalance != "" {
+			return fmt.Errorf("LoadBalance already defined as '%s' in previous config file", to.Network.LoadBalance)
+		}
+		to.Network.LoadBalance = from.Network.LoadBalance
+	}
+	if from.Network.ReconnectBackoff != nil {
+		if to.Network.ReconnectBackoff != nil {
+			return fmt.Errorf("ReconnectBackoff already defined in previous config file")
+		}
+		to.Network.ReconnectBackoff = from.Network.ReconnectBackoff
+	}
+	if from.Queue.Path != "" {
+		if to.Queue.Path != "" {
+			return fmt.Errorf("Queue path already defined as '%s' in previous config file", to.Queue.Path)
+		}
+		to.Queue.Path = from.Queue.Path
+	}
+	if from.Queue.SegmentSize != 0 {
+		if to.Queue.SegmentSize != 0 {
+			return fmt.Errorf("Queue segment size already defined as '%d' in previous config file", to.Queue.SegmentSize)
+		}
+		to.Queue.SegmentSize = from.Queue.SegmentSize
+	}
+	if from.Queue.MaxSize != 0 {
+		if to.Queue.MaxSize != 0 {
+			return fmt.Errorf("Queue max size already defined as '%d' in previous config file", to.Queue.MaxSize)
+		}
+		to.Queue.MaxSize = from.Queue.MaxSize
+	}
+	if from.Queue.Fsync != "" {
+		if to.Queue.Fsync != "" {
+			return fmt.Errorf("Queue fsync already defined as '%s' in previous config file", to.Queue.Fsync)
+		}
+		to.Queue.Fsync = from.Queue.Fsync
+	}
 	return nil
 }
 
 func LoadConfig(path string) (config Config, err error) {
-	config_file, err := os.Open(path)
+	buffer, err := readConfigFile(path)
 	if err != nil {
-		emit("Failed to open config file '%s': %s\n", path, err)
+		emit("%s\n", err)
 		return
 	}
-
-	fi, _ := config_file.Stat()
-	if size := fi.Size(); size > (configFileSizeLimit) {
-		emit("config file (%q) size exceeds reasonable limit (%d) - aborting", path, size)
-		return // REVU: shouldn't this return an error, then?
-	}
-
-	if fi.Size() == 0 {
+	if len(buffer) == 0 {
 		emit("config file (%q) is empty, skipping", path)
 		return
 	}
-
-	buffer := make([]byte, fi.Size())
-	_, err = config_file.Read(buffer)
 	emit("%s\n", buffer)
 
-	buffer, err = StripComments(buffer)
+	err = json.Unmarshal(buffer, &config)
 	if err != nil {
-		emit("Failed to strip comments from json: %s\n", err)
+		emit("Failed unmarshalling json: %s\n", err)
 		return
 	}
 
-	buffer = []byte(os.ExpandEnv(string(buffer)))
+	if err = loadNetworkConfig(&config.Network); err != nil {
+		emit("Failed to load network config: %s\n", err)
+		return
+	}
 
-	err = json.Unmarshal(buffer, &config)
-	if err != nil {
-		emit("Failed unmarshalling json: %s\n", err)
+	if err = loadQueueConfig(&config.Queue); err != nil {
+		emit("Failed to load queue config: %s\n", err)
 		return
 	}
 
 	for k, _ := range config.Files {
-		if config.Files[k].DeadTime == "" {
-			config.Files[k].DeadTime = defaultConfig.fileDeadtime
+		if err = loadFileConfig(&config.Files[k]); err != nil {
+			emit("Failed to load file config: %s\n", err)
+			return
 		}
-		config.Files[k].deadtime, err = time.ParseDuration(config.Files[k].DeadTime)
+	}
+
+	return
+}
+
+func loadNetworkConfig(network *NetworkConfig) (err error) {
+	if network.ReconnectBackoff != nil {
+		if err = loadBackoffConfig("reconnect backoff", network.ReconnectBackoff, defaultConfig.reconnectMin, defaultConfig.reconnectMax); err != nil {
+			return
+		}
+	}
+
+	switch network.Transport {
+	case "", "tls", "tcp":
+	default:
+		return fmt.Errorf("transport must be 'tls' or 'tcp', not '%s'", network.Transport)
+	}
+
+	for _, pin := range network.SSLPins {
+		if _, err = parsePin(pin); err != nil {
+			return
+		}
+	}
+	if network.SSLPinOnly && len(network.SSLPins) == 0 {
+		return fmt.Errorf("ssl pin only needs at least one pin in ssl pins")
+	}
+
+	if _, _, _, _, err = tlsOptions(network); err != nil {
+		return
+	}
+	return nil
+}
+
+func loadQueueConfig(queue *QueueConfig) error {
+	if queue.SegmentSize < 0 {
+		return fmt.Errorf("queue segment size must be positive, not %d", queue.SegmentSize)
+	}
+	if queue.MaxSize < 0 {
+		return fmt.Errorf("queue max size must be positive, not %d", queue.MaxSize)
+	}
+	if queue.SegmentSize != 0 && queue.MaxSize != 0 && queue.MaxSize < queue.SegmentSize {
+		return fmt.Errorf("queue max size (%d) is less than the segment size (%d)", queue.MaxSize, queue.SegmentSize)
+	}
+
+	switch queue.Fsync {
+	case "", "always", "segment", "never":
+	default:
+		return fmt.Errorf("queue fsync must be 'always', 'segment' or 'never', not '%s'", queue.Fsync)
+	}
+	return nil
+}
+
+func loadFileConfig(fileconfig *FileConfig) (err error) {
+	if err = loadDuration("dead time", &fileconfig.DeadTime, defaultConfig.fileDeadtime, &fileconfig.deadtime); err != nil {
+		return
+	}
+
+	if fileconfig.MaxLineBytes == 0 {
+		fileconfig.MaxLineBytes = defaultConfig.maxLineBytes
+	}
+	if fileconfig.MaxLineBytes < 0 {
+		return fmt.Errorf("max line bytes must be positive, not %d", fileconfig.MaxLineBytes)
+	}
+
+	if fileconfig.codec, err = findCodec(fileconfig.Encoding); err != nil {
+		return
+	}
+
+	switch fileconfig.Discovery {
+	case "":
+		fileconfig.Discovery = "poll"
+	case "poll", "inotify":
+	default:
+		return fmt.Errorf("discovery must be 'poll' or 'inotify', not '%s'", fileconfig.Discovery)
+	}
+
+	if err = loadDuration("scan frequency", &fileconfig.ScanFrequency, defaultConfig.scanFrequency, &fileconfig.scanFrequency); err != nil {
+		return
+	}
+	if err = loadDuration("idle timeout", &fileconfig.IdleTimeout, defaultConfig.idleTimeout, &fileconfig.idleTimeout); err != nil {
+		return
+	}
+
+	if fileconfig.Backoff == nil {
+		fileconfig.Backoff = &BackoffConfig{}
+	}
+	if err = loadBackoffConfig("harvester backoff", fileconfig.Backoff, defaultConfig.backoffMin, defaultConfig.backoffMax); err != nil {
+		return
+	}
+
+	if fileconfig.MaxGlobDepth == 0 {
+		fileconfig.MaxGlobDepth = defaultConfig.maxGlobDepth
+	}
+	if fileconfig.MaxGlobDepth < 0 {
+		return fmt.Errorf("max glob depth must be positive, not %d", fileconfig.MaxGlobDepth)
+	}
+
+	fileconfig.excludeFiles = nil
+	for _, pattern := range fileconfig.ExcludeFiles {
+		exclude, err := newExcludePattern(pattern)
 		if err != nil {
-			emit("Failed to parse dead time duration '%s'. Error was: %s\n", config.Files[k].DeadTime, err)
+			return err
+		}
+		fileconfig.excludeFiles = append(fileconfig.excludeFiles, exclude)
+	}
+
+	if fileconfig.includeLines, err = compilePatterns("include lines", fileconfig.IncludeLines); err != nil {
+		return
+	}
+	if fileconfig.dropLines, err = compilePatterns("drop lines", fileconfig.DropLines); err != nil {
+		return
+	}
+
+	if multiline := fileconfig.Multiline; multiline != nil {
+		if err = loadMultilineConfig(multiline); err != nil {
 			return
 		}
 	}
 
-	return
+	if fileconfig.JSON != nil {
+		if fileconfig.JSON.MessageKey == "" {
+			fileconfig.JSON.MessageKey = defaultConfig.jsonMessageKey
+		}
+		if fileconfig.JSON.ErrorKey == "" {
+			fileconfig.JSON.ErrorKey = defaultConfig.jsonErrorKey
+		}
+	}
+	return nil
+}
+
+// Return true if the file is gzip compressed and is to be read as such.
+func (fileconfig *FileConfig) isCompressed(file string) bool {
+	return fileconfig.Gzip && strings.HasSuffix(file, ".gz")
+}
+
+func compilePatterns(name string, patterns []string) (compiled []*regexp.Regexp, err error) {
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern '%s': %s", name, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func loadBackoffConfig(name string, backoff *BackoffConfig, min string, max string) (err error) {
+	if err = loadDuration(name+" min", &backoff.Min, min, &backoff.min); err != nil {
+		return
+	}
+	if backoff.Max == "" {
+		// A min above the default max raises the max with it
+		if fallback, _ := time.ParseDuration(max); fallback < backoff.min {
+			max = backoff.Min
+		}
+	}
+	if err = loadDuration(name+" max", &backoff.Max, max, &backoff.max); err != nil {
+		return
+	}
+	if backoff.max < backoff.min {
+		return fmt.Errorf("%s max (%s) is less than min (%s)", name, backoff.Max, backoff.Min)
+	}
+
+	if backoff.Multiplier == 0 {
+		backoff.Multiplier = defaultConfig.backoffMultiplier
+	}
+	if backoff.Multiplier < 1 {
+		return fmt.Errorf("%s multiplier must be at least 1, not %v", name, backoff.Multiplier)
+	}
+	return nil
+}
+
+// Parse the duration option called name into parsed, defaulting it first if
+// it is not set. Durations must be positive.
+func loadDuration(name string, value *string, fallback string, parsed *time.Duration) (err error) {
+	if *value == "" {
+		*value = fallback
+	}
+	if *parsed, err = time.ParseDuration(*value); err != nil {
+		return fmt.Errorf("failed to parse %s duration '%s': %s", name, *value, err)
+	}
+	if *parsed <= 0 {
+		return fmt.Errorf("%s must be positive, not '%s'", name, *value)
+	}
+	return nil
+}
+
+func loadMultilineConfig(multiline *MultilineConfig) (err error) {
+	if multiline.Pattern == "" {
+		return fmt.Errorf("multiline pattern is required")
+	}
+	if multiline.regexp, err = regexp.Compile(multiline.Pattern); err != nil {
+		return fmt.Errorf("invalid multiline pattern '%s': %s", multiline.Pattern, err)
+	}
+
+	if multiline.Match == "" {
+		multiline.Match = defaultConfig.multilineMatch
+	}
+	if multiline.Match != "after" && multiline.Match != "before" {
+		return fmt.Errorf("multiline match must be 'after' or 'before', not '%s'", multiline.Match)
+	}
+
+	if multiline.MaxLines == 0 {
+		multiline.MaxLines = defaultConfig.multilineMaxLines
+	}
+	if multiline.MaxLines < 0 {
+		return fmt.Errorf("multiline max lines must be positive, not %d", multiline.MaxLines)
+	}
+
+	return loadDuration("multiline timeout", &multiline.Timeout, defaultConfig.multilineTimeout, &multiline.timeout)
 }
 
 func FinalizeConfig(config *Config) {
@@ -153,22 +626,79 @@ func FinalizeConfig(config *Config) {
 	}
 
 	config.Network.timeout = time.Duration(config.Network.Timeout) * time.Second
+
+	if config.Network.Protocol == 0 {
+		config.Network.Protocol = defaultConfig.netProtocol
+	}
+	if config.Network.Transport == "" {
+		config.Network.Transport = defaultConfig.netTransport
+	}
+	if config.Network.WindowsInFlight == 0 {
+		config.Network.WindowsInFlight = defaultConfig.windowsInFlight
+	}
+	if config.Network.ReconnectBackoff == nil {
+		config.Network.ReconnectBackoff = &BackoffConfig{}
+		loadBackoffConfig("reconnect backoff", config.Network.ReconnectBackoff, defaultConfig.reconnectMin, defaultConfig.reconnectMax)
+	}
+
+	if config.Queue.SegmentSize == 0 {
+		config.Queue.SegmentSize = defaultConfig.queueSegmentSize
+	}
+	if config.Queue.MaxSize == 0 {
+		config.Queue.MaxSize = defaultConfig.queueMaxSize
+	}
+	if config.Queue.Fsync == "" {
+		config.Queue.Fsync = defaultConfig.queueFsync
+	}
+}
+
+// Read a config file, with comments stripped and environment variables
+// expanded, ready to unmarshal. Returns nothing for an empty file.
+func readConfigFile(path string) ([]byte, error) {
+	config_file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open config file '%s': %s", path, err)
+	}
+	defer config_file.Close()
+
+	fi, err := config_file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat config file '%s': %s", path, err)
+	}
+	if size := fi.Size(); size > configFileSizeLimit {
+		return nil, fmt.Errorf("config file (%q) size exceeds reasonable limit (%d) - aborting", path, size)
+	}
+
+	buffer, err := ioutil.ReadAll(config_file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file '%s': %s", path, err)
+	}
+	if len(buffer) == 0 {
+		return nil, nil
+	}
+
+	buffer, err = StripComments(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to strip comments from json: %s", err)
+	}
+	return []byte(os.ExpandEnv(string(buffer))), nil
 }
 
+// Blank out comment lines, keeping the lines after them where they were so
+// errors can be reported at their line in the file.
 func StripComments(data []byte) ([]byte, error) {
-	data = bytes.Replace(data, []byte("\r"), []byte(""), 0) // Windows
+	data = bytes.Replace(data, []byte("\r"), []byte(""), -1) // Windows
 	lines := bytes.Split(data, []byte("\n"))
-	filtered := make([][]byte, 0)
 
-	for _, line := range lines {
+	for i, line := range lines {
 		match, err := regexp.Match(`^\s*#`, line)
 		if err != nil {
 			return nil, err
 		}
-		if !match {
-			filtered = append(filtered, line)
+		if match {
+			lines[i] = nil
 		}
 	}
 
-	return bytes.Join(filtered, []byte("\n")), nil
+	return bytes.Join(lines, []byte("\n")), nil
 }
@@ -115,6 +115,15 @@ func TestLoadConfigAndStripComments(t *testing.T) {
 	}
 
 	defaultDeadTime, _ := time.ParseDuration(defaultConfig.fileDeadtime)
+	defaultScanFrequency, _ := time.ParseDuration(defaultConfig.scanFrequency)
+	defaultIdleTimeout, _ := time.ParseDuration(defaultConfig.idleTimeout)
+	defaultBackoff := &BackoffConfig{
+		Min:        defaultConfig.backoffMin,
+		Max:        defaultConfig.backoffMax,
+		Multiplier: defaultConfig.backoffMultiplier,
+		min:        time.Second,
+		max:        time.Second,
+	}
 	expected := Config{
 		Network: NetworkConfig{
 			Servers:        []string{"localhost:5043"},
@@ -124,15 +133,33 @@ func TestLoadConfigAndStripComments(t *testing.T) {
 			Timeout:        20,
 		},
 		Files: []FileConfig{{
-			Paths:    []string{"/var/log/*.log", "/var/log/messages"},
-			Fields:   map[string]string{"type": "syslog"},
-			DeadTime: "6h",
-			deadtime: 21600000000000,
+			Paths:         []string{"/var/log/*.log", "/var/log/messages"},
+			Fields:        map[string]string{"type": "syslog"},
+			DeadTime:      "6h",
+			MaxLineBytes:  defaultConfig.maxLineBytes,
+			Discovery:     "poll",
+			ScanFrequency: defaultConfig.scanFrequency,
+			IdleTimeout:   defaultConfig.idleTimeout,
+			Backoff:       defaultBackoff,
+			MaxGlobDepth:  defaultConfig.maxGlobDepth,
+			deadtime:      21600000000000,
+			codec:         plainCodec,
+			scanFrequency: defaultScanFrequency,
+			idleTimeout:   defaultIdleTimeout,
 		}, {
-			Paths:    []string{"/var/log/apache2/access.log"},
-			Fields:   map[string]string{"type": "apache"},
-			DeadTime: defaultConfig.fileDeadtime,
-			deadtime: defaultDeadTime,
+			Paths:         []string{"/var/log/apache2/access.log"},
+			Fields:        map[string]string{"type": "apache"},
+			DeadTime:      defaultConfig.fileDeadtime,
+			MaxLineBytes:  defaultConfig.maxLineBytes,
+			Discovery:     "poll",
+			ScanFrequency: defaultConfig.scanFrequency,
+			IdleTimeout:   defaultConfig.idleTimeout,
+			Backoff:       defaultBackoff,
+			MaxGlobDepth:  defaultConfig.maxGlobDepth,
+			deadtime:      defaultDeadTime,
+			codec:         plainCodec,
+			scanFrequency: defaultScanFrequency,
+			idleTimeout:   defaultIdleTimeout,
 		}},
 	}
 
@@ -142,6 +169,50 @@ func TestLoadConfigAndStripComments(t *testing.T) {
 
 }
 
+func TestLoadFileConfigErrors(t *testing.T) {
+	bad := []FileConfig{
+		{DeadTime: "forever"},
+		{MaxLineBytes: -1},
+		{Encoding: "ebcdic"},
+		{Discovery: "psychic"},
+		{ScanFrequency: "0s"},
+		{IdleTimeout: "-1s"},
+		{Backoff: &BackoffConfig{Min: "10s", Max: "1s"}},
+		{Backoff: &BackoffConfig{Multiplier: 0.5}},
+		{Multiline: &MultilineConfig{}},
+		{ExcludeFiles: []string{"*.log["}},
+		{ExcludeFiles: []string{"/(/"}},
+		{MaxGlobDepth: -1},
+		{IncludeLines: []string{"("}},
+		{DropLines: []string{"["}},
+	}
+	for _, fileconfig := range bad {
+		if err := loadFileConfig(&fileconfig); err == nil {
+			t.Errorf("Expected an error loading file config %v", fileconfig)
+		}
+	}
+}
+
+func TestExcludeFiles(t *testing.T) {
+	p := &Prospector{FileConfig: FileConfig{
+		ExcludeFiles: []string{"*.gz", "/var/log/other/*", `/debug-\d+\.log$/`},
+	}}
+	chkerr(t, loadFileConfig(&p.FileConfig))
+
+	tests := map[string]bool{
+		"/var/log/app.log":          false,
+		"/var/log/app.log.1.gz":     true,
+		"/var/log/other/app.log":    true,
+		"/var/log/debug-1234.log":   true,
+		"/var/log/debug-1234.log.1": false,
+	}
+	for file, expected := range tests {
+		if p.isExcluded(file) != expected {
+			t.Errorf("Expected isExcluded(%s) to be %t", file, expected)
+		}
+	}
+}
+
 func TestFinalizeConfig(t *testing.T) {
 	config := Config{}
 
@@ -208,3 +279,57 @@ func TestMergeConfig(t *testing.T) {
 		t.Fatalf("Expected a double merge attempt to give us an error, it didn't")
 	}
 }
+
+func TestLoadOversizedConfig(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	configFile := path.Join(tmpdir, "myconfig")
+	err := ioutil.WriteFile(configFile, make([]byte, configFileSizeLimit+1), 0644)
+	chkerr(t, err)
+
+	if _, err = LoadConfig(configFile); err == nil {
+		t.Fatalf("Expected an error loading a config file over the size limit")
+	}
+}
+
+func TestCheckConfigFile(t *testing.T) {
+	configJson := `{
+  # Comments don't move the lines after them
+  "network": {
+    "servers": [ "localhost:5043" ],
+    "sll ca": "./logstash-forwarder.ca",
+    "timeout": "20"
+  },
+  "files": [
+    {
+      "paths": [ "/var/log/*.log" ],
+      "fields": { "any key": "is fine" },
+      "dead time": "6 hours",
+      "encoding": "klingon"
+    }
+  ]
+}`
+
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	configFile := path.Join(tmpdir, "myconfig")
+	err := ioutil.WriteFile(configFile, []byte(configJson), 0644)
+	chkerr(t, err)
+
+	_, problems := checkConfigFile(configFile)
+	expected := []string{
+		configFile + `:6:16: network.timeout must be int64, not string`,
+		configFile + `:5:5: unknown option "sll ca"`,
+		configFile + `:12:20: files[0].dead time is not a duration: time: unknown unit " hours" in duration "6 hours"`,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.String() != expected[i] {
+			t.Errorf("Expected problem %d to be %s, got %s", i, expected[i], problem)
+		}
+	}
+}
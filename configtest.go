@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A problem -configtest found with a config file, at the line and column of
+// the key or value it is about when known.
+type configProblem struct {
+	file         string
+	line, column int
+	message      string
+	warning      bool
+}
+
+func (p configProblem) String() string {
+	where := p.file
+	if p.line > 0 {
+		where = fmt.Sprintf("%s:%d:%d", p.file, p.line, p.column)
+	}
+	if p.warning {
+		return fmt.Sprintf("%s: warning: %s", where, p.message)
+	}
+	return fmt.Sprintf("%s: %s", where, p.message)
+}
+
+// The string options that hold a duration, by type and field name.
+var durationFields = map[string]bool{
+	"FileConfig.DeadTime":      true,
+	"FileConfig.ScanFrequency": true,
+	"FileConfig.IdleTimeout":   true,
+	"MultilineConfig.Timeout":  true,
+	"BackoffConfig.Min":        true,
+	"BackoffConfig.Max":        true,
+}
+
+// A problem found while walking a config file, at an offset into it. Path is
+// set for bad values, which the option's own checks would report again.
+type walkProblem struct {
+	offset  int64
+	path    string
+	message string
+}
+
+// Walks the JSON of a config file alongside the types it is unmarshalled
+// into, finding keys that match no option and durations that don't parse,
+// and where each option starts.
+type configWalker struct {
+	data     []byte
+	decoder  *json.Decoder
+	offsets  map[string]int64 // by path, such as "files[1].multiline"
+	problems []walkProblem
+}
+
+func walkConfig(data []byte) (*configWalker, error) {
+	w := &configWalker{
+		data:    data,
+		decoder: json.NewDecoder(strings.NewReader(string(data))),
+		offsets: make(map[string]int64),
+	}
+	return w, w.value("", reflect.TypeOf(Config{}), false)
+}
+
+// The offset of the next token, past the whitespace and separators that the
+// decoder has not read yet.
+func (w *configWalker) next() int64 {
+	offset := w.decoder.InputOffset()
+	for offset < int64(len(w.data)) && strings.IndexByte(" \t\r\n,:", w.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// Walk the value at path, to be unmarshalled into t. A nil t is for values
+// with no option to go to, whose keys are not checked.
+func (w *configWalker) value(path string, t reflect.Type, duration bool) error {
+	offset := w.next()
+	w.offsets[path] = offset
+	token, err := w.decoder.Token()
+	if err != nil {
+		return err
+	}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for w.decoder.More() {
+			key_offset := w.next()
+			token, err := w.decoder.Token()
+			if err != nil {
+				return err
+			}
+			key := token.(string)
+
+			var elem reflect.Type
+			elem_duration := false
+			elem_path := key
+			switch {
+			case t == nil:
+			case t.Kind() == reflect.Map:
+				elem = t.Elem()
+				elem_path = fmt.Sprintf("%s[%q]", path, key)
+			case t.Kind() == reflect.Struct:
+				if field, ok := optionField(t, key); ok {
+					elem = field.Type
+					elem_duration = durationFields[t.Name()+"."+field.Name]
+					elem_path = optionName(field)
+				} else {
+					w.problems = append(w.problems, walkProblem{key_offset, "", fmt.Sprintf("unknown option %q", key)})
+				}
+			}
+			if path != "" && (t == nil || t.Kind() != reflect.Map) {
+				elem_path = path + "." + elem_path
+			}
+
+			if err = w.value(elem_path, elem, elem_duration); err != nil {
+				return err
+			}
+		}
+		_, err = w.decoder.Token()
+		return err
+
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+		for i := 0; w.decoder.More(); i++ {
+			if err = w.value(fmt.Sprintf("%s[%d]", path, i), elem, false); err != nil {
+				return err
+			}
+		}
+		_, err = w.decoder.Token()
+		return err
+	}
+
+	if value, ok := token.(string); ok && duration && value != "" {
+		if parsed, err := time.ParseDuration(value); err != nil {
+			w.problems = append(w.problems, walkProblem{offset, path, fmt.Sprintf("%s is not a duration: %s", path, err)})
+		} else if parsed <= 0 {
+			w.problems = append(w.problems, walkProblem{offset, path, fmt.Sprintf("%s must be positive, not '%s'", path, value)})
+		}
+	}
+	return nil
+}
+
+// The option of struct type t that key sets, matched the same way as
+// encoding/json does.
+func optionField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+		if strings.EqualFold(optionName(field), key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func optionName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// The path the walker gives the field of an UnmarshalTypeError, such as
+// "files[0].dead time" for "files.0.dead time".
+func typeErrorPath(field string) string {
+	parts := strings.Split(field, ".")
+	path := ""
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			path += "[" + part + "]"
+		} else if path == "" {
+			path = part
+		} else {
+			path += "." + part
+		}
+	}
+	return path
+}
+
+// The line and column, counting from 1, of the byte at offset.
+func position(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = strings.Count(string(before), "\n") + 1
+	column = int(offset) - strings.LastIndex(string(before), "\n")
+	return line, column
+}
+
+// Load a config file strictly, returning every problem found in it.
+func checkConfigFile(filename string) (config Config, problems []configProblem) {
+	data, err := readConfigFile(filename)
+	if err != nil {
+		return config, []configProblem{{file: filename, message: err.Error()}}
+	}
+	if len(data) == 0 {
+		return config, []configProblem{{file: filename, message: "the file is empty", warning: true}}
+	}
+
+	at := func(offset int64, message string) configProblem {
+		line, column := position(data, offset)
+		return configProblem{file: filename, line: line, column: column, message: message}
+	}
+
+	// A syntax error leaves nothing else to check
+	var type_error *json.UnmarshalTypeError
+	if err = json.Unmarshal(data, &config); err != nil {
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			return config, []configProblem{at(err.Offset, err.Error())}
+		case *json.UnmarshalTypeError:
+			type_error = err
+		default:
+			return config, []configProblem{{file: filename, message: err.Error()}}
+		}
+	}
+
+	walker, err := walkConfig(data)
+	if err != nil {
+		return config, []configProblem{{file: filename, message: err.Error()}}
+	}
+	if type_error != nil {
+		// The error's offset is past the value, so report where it starts
+		path := typeErrorPath(type_error.Field)
+		offset := type_error.Offset - 1
+		if start, ok := walker.offsets[path]; ok {
+			offset = start
+		}
+		problems = append(problems, at(offset, fmt.Sprintf("%s must be %s, not %s", path, type_error.Type, type_error.Value)))
+	}
+	for _, problem := range walker.problems {
+		problems = append(problems, at(problem.offset, problem.message))
+	}
+
+	// Check the rest of each section, unless it already had a problem
+	checked := func(section string, err error) {
+		if err == nil {
+			return
+		}
+		for _, problem := range walker.problems {
+			if problem.path == "" {
+				continue
+			}
+			if problem.path == section || strings.HasPrefix(problem.path, section+".") {
+				return
+			}
+		}
+		if offset, ok := walker.offsets[section]; ok {
+			problems = append(problems, at(offset, err.Error()))
+		} else {
+			problems = append(problems, configProblem{file: filename, message: err.Error()})
+		}
+	}
+	checked("network", loadNetworkConfig(&config.Network))
+	checked("queue", loadQueueConfig(&config.Queue))
+	for k := range config.Files {
+		checked(fmt.Sprintf("files[%d]", k), loadFileConfig(&config.Files[k]))
+	}
+	return config, problems
+}
+
+// Load every config file of -config strictly and check the merged config can
+// be used: that the TLS files can be read and what the globs match. Returns
+// the merged config and every problem found.
+func checkConfigs(config_arg string) (config Config, problems []configProblem) {
+	config_files, err := DiscoverConfigs(config_arg)
+	if err != nil {
+		return config, []configProblem{{file: config_arg, message: err.Error()}}
+	}
+
+	for _, filename := range config_files {
+		additional_config, file_problems := checkConfigFile(filename)
+		problems = append(problems, file_problems...)
+		if err = MergeConfig(&config, additional_config); err != nil {
+			problems = append(problems, configProblem{file: filename, message: err.Error()})
+		}
+	}
+	FinalizeConfig(&config)
+
+	if len(config.Files) == 0 {
+		problems = append(problems, configProblem{file: config_arg, message: "no paths given"})
+	}
+	if _, err = publisherFor(&config.Network); err != nil {
+		problems = append(problems, configProblem{file: config_arg, message: err.Error()})
+	}
+	if config.Network.Transport != "tcp" {
+		if _, _, err = loadTLSMaterial(&config.Network); err != nil {
+			problems = append(problems, configProblem{file: config_arg, message: err.Error()})
+		}
+	}
+
+	for _, fileconfig := range config.Files {
+		for _, path := range fileconfig.Paths {
+			if path == "-" {
+				continue
+			}
+			matches, err := expandGlob(path, fileconfig.MaxGlobDepth)
+			if err != nil {
+				problems = append(problems, configProblem{file: config_arg, message: fmt.Sprintf("invalid path %s: %s", path, err)})
+				continue
+			}
+			if len(matches) == 0 {
+				problems = append(problems, configProblem{file: config_arg, message: fmt.Sprintf("path %s matches no files yet", path), warning: true})
+			}
+			for _, match := range matches {
+				file, err := os.Open(match)
+				if err != nil {
+					problems = append(problems, configProblem{file: config_arg, message: fmt.Sprintf("path %s matches a file that can't be read: %s", path, err)})
+					continue
+				}
+				file.Close()
+			}
+		}
+	}
+	return config, problems
+}
+
+// Check the config of -config, print the problems found and the merged
+// config, and exit with a non-zero status if there are any problems but
+// warnings.
+func configTest(config_arg string) {
+	config, problems := checkConfigs(config_arg)
+
+	failed := 0
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+		if !problem.warning {
+			failed++
+		}
+	}
+
+	merged, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fault("Failed to print the config: %s", err)
+	}
+	fmt.Printf("%s\n", merged)
+
+	if failed > 0 {
+		exit(exitStat.faulted, "Config test failed with %d problems", failed)
+	}
+	exit(exitStat.ok, "Config test passed")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A codec splits lines of a file in a given character encoding and decodes
+// them to UTF-8. Lines are split on the encoded form of the newline, so the
+// offsets recorded for each line remain byte offsets into the original file.
+type codec struct {
+	name     string
+	unit     int    // bytes per code unit
+	newline  []byte // encoded "\n"
+	carriage []byte // encoded "\r"
+	bom      []byte // byte order mark skipped at the start of the file, if any
+	decode   func([]byte) string
+
+	// Variants to pick from by byte order mark, the first being the default
+	detect []*codec
+}
+
+var plainCodec = &codec{
+	name:     "plain",
+	unit:     1,
+	newline:  []byte("\n"),
+	carriage: []byte("\r"),
+	decode:   func(raw []byte) string { return string(raw) },
+}
+
+var utf8Codec = &codec{
+	name:     "utf-8",
+	unit:     1,
+	newline:  []byte("\n"),
+	carriage: []byte("\r"),
+	bom:      []byte{0xef, 0xbb, 0xbf},
+	decode:   func(raw []byte) string { return string(raw) },
+}
+
+var latin1Codec = &codec{
+	name:     "latin1",
+	unit:     1,
+	newline:  []byte("\n"),
+	carriage: []byte("\r"),
+	decode:   decodeLatin1,
+}
+
+var utf16beCodec = &codec{
+	name:     "utf-16be",
+	unit:     2,
+	newline:  []byte{0, '\n'},
+	carriage: []byte{0, '\r'},
+	bom:      []byte{0xfe, 0xff},
+	decode:   func(raw []byte) string { return decodeUTF16(raw, 0, 1) },
+}
+
+var utf16leCodec = &codec{
+	name:     "utf-16le",
+	unit:     2,
+	newline:  []byte{'\n', 0},
+	carriage: []byte{'\r', 0},
+	bom:      []byte{0xff, 0xfe},
+	decode:   func(raw []byte) string { return decodeUTF16(raw, 1, 0) },
+}
+
+// Trail bytes of Shift-JIS are never '\n' or '\r', so lines split as in ASCII
+var shiftJISCodec = &codec{
+	name:     "shift_jis",
+	unit:     1,
+	newline:  []byte("\n"),
+	carriage: []byte("\r"),
+	decode:   decodeShiftJIS,
+}
+
+// Without a byte order mark UTF-16 is big endian (RFC 2781)
+var utf16Codec = &codec{
+	name:   "utf-16",
+	unit:   2,
+	detect: []*codec{utf16beCodec, utf16leCodec},
+}
+
+var codecs = map[string]*codec{
+	"plain":      plainCodec,
+	"utf-8":      utf8Codec,
+	"utf8":       utf8Codec,
+	"latin1":     latin1Codec,
+	"iso-8859-1": latin1Codec,
+	"utf-16":     utf16Codec,
+	"utf16":      utf16Codec,
+	"utf-16be":   utf16beCodec,
+	"utf-16le":   utf16leCodec,
+	"shift_jis":  shiftJISCodec,
+	"shift-jis":  shiftJISCodec,
+	"sjis":       shiftJISCodec,
+}
+
+func findCodec(name string) (*codec, error) {
+	if name == "" {
+		return plainCodec, nil
+	}
+	if c, ok := codecs[strings.ToLower(name)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding '%s'", name)
+}
+
+// Pick the variant of c to use for a file we start reading part way into, by
+// looking at the byte order mark at its start.
+func (c *codec) resolve(file *os.File) *codec {
+	if len(c.detect) == 0 {
+		return c
+	}
+	for _, variant := range c.detect {
+		mark := make([]byte, len(variant.bom))
+		if _, err := file.ReadAt(mark, 0); err == nil && bytes.Equal(mark, variant.bom) {
+			return variant
+		}
+	}
+	return c.detect[0]
+}
+
+// Skip any byte order mark at the start of the file. Returns the codec to use
+// for the rest of the file and the number of bytes skipped. An error is
+// returned if too little of the file has been written yet to tell.
+func (c *codec) skipBOM(reader *bufio.Reader) (*codec, int, error) {
+	candidates := c.detect
+	if len(candidates) == 0 {
+		candidates = []*codec{c}
+	}
+
+	for _, candidate := range candidates {
+		if len(candidate.bom) == 0 {
+			continue
+		}
+		peek, err := reader.Peek(len(candidate.bom))
+		if bytes.Equal(peek, candidate.bom) {
+			reader.Discard(len(candidate.bom))
+			return candidate, len(candidate.bom), nil
+		}
+		if err != nil && bytes.HasPrefix(candidate.bom, peek) {
+			// Could still be a byte order mark, wait for more data
+			return c, 0, err
+		}
+	}
+
+	return candidates[0], 0, nil
+}
+
+// Read the next part of a line, up to and including the encoded newline if
+// one is found. The data returned is only valid until the next read.
+func (c *codec) readSegment(reader *bufio.Reader) ([]byte, error) {
+	if c.unit == 1 {
+		// ReadSlice, unlike ReadBytes, won't grow beyond the reader's buffer
+		// size when a line is long, so the caller can decide what to keep
+		return reader.ReadSlice(c.newline[0])
+	}
+
+	// Only consume whole code units, so the newline is always aligned
+	if _, err := reader.Peek(c.unit); err != nil {
+		return nil, err
+	}
+	data, _ := reader.Peek(reader.Buffered() - reader.Buffered()%c.unit)
+	for i := 0; i < len(data); i += c.unit {
+		if bytes.Equal(data[i:i+c.unit], c.newline) {
+			data = data[:i+c.unit]
+			break
+		}
+	}
+	reader.Discard(len(data))
+	return data, nil
+}
+
+func (c *codec) endsLine(segment []byte) bool {
+	return bytes.HasSuffix(segment, c.newline)
+}
+
+// Strip the EOL chars (CRLF or LF) from a line.
+func (c *codec) trimEOL(line []byte) []byte {
+	if !c.endsLine(line) {
+		return line
+	}
+	line = line[:len(line)-len(c.newline)]
+	return bytes.TrimSuffix(line, c.carriage)
+}
+
+func decodeLatin1(raw []byte) string {
+	decoded := make([]byte, 0, len(raw))
+	for _, b := range raw {
+		if b < utf8.RuneSelf {
+			decoded = append(decoded, b)
+		} else {
+			var encoded [utf8.UTFMax]byte
+			n := utf8.EncodeRune(encoded[:], rune(b))
+			decoded = append(decoded, encoded[:n]...)
+		}
+	}
+	return string(decoded)
+}
+
+// Decode UTF-16 given the index of the high and low byte in each code unit.
+func decodeUTF16(raw []byte, high, low int) string {
+	units := make([]uint16, len(raw)/2)
+	for i := range units {
+		units[i] = uint16(raw[2*i+high])<<8 | uint16(raw[2*i+low])
+	}
+	return string(utf16.Decode(units))
+}
+
+// Decode Shift-JIS as the WHATWG Encoding Standard does: bytes that aren't
+// part of a character become U+FFFD, and an ASCII byte after a lead byte is
+// decoded on its own.
+func decodeShiftJIS(raw []byte) string {
+	decoded := make([]byte, 0, len(raw)*3/2)
+	add := func(r rune) {
+		var encoded [utf8.UTFMax]byte
+		n := utf8.EncodeRune(encoded[:], r)
+		decoded = append(decoded, encoded[:n]...)
+	}
+
+	for i := 0; i < len(raw); i++ {
+		b := raw[i]
+		switch {
+		case b < utf8.RuneSelf:
+			decoded = append(decoded, b)
+		case b == 0x80:
+			add(rune(b))
+		case b >= 0xa1 && b <= 0xdf:
+			// Half width katakana
+			add(0xff61 + rune(b-0xa1))
+		case (b >= 0x81 && b <= 0x9f || b >= 0xe0 && b <= 0xfc) && i+1 < len(raw):
+			r := shiftJISRune(b, raw[i+1])
+			if r != utf8.RuneError || raw[i+1] >= utf8.RuneSelf {
+				i++
+			}
+			add(r)
+		default:
+			add(utf8.RuneError)
+		}
+	}
+	return string(decoded)
+}
+
+// The character of the double byte code lead, trail, or U+FFFD if there is
+// none.
+func shiftJISRune(lead, trail byte) rune {
+	if trail < 0x40 || trail == 0x7f || trail > 0xfc {
+		return utf8.RuneError
+	}
+	pointer := int(trail) - 0x40
+	if trail > 0x7f {
+		pointer--
+	}
+	if lead < 0xa0 {
+		pointer += int(lead-0x81) * 188
+	} else {
+		pointer += int(lead-0xc1) * 188
+	}
+	if r := shiftJISTable[pointer]; r != 0 {
+		return rune(r)
+	}
+	return utf8.RuneError
+}
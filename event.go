@@ -1,13 +1,62 @@
 package main
 
-import "os"
+import (
+  "encoding/json"
+  "os"
+)
 
 type FileEvent struct {
-  Source *string `json:"source,omitempty"`
-  Offset int64   `json:"offset,omitempty"`
-  Line   uint64  `json:"line,omitempty"`
-  Text   *string `json:"text,omitempty"`
-  Fields *map[string]string
+  Source   *string `json:"source,omitempty"`
+  Offset   int64   `json:"offset,omitempty"`
+  RawBytes int64   `json:"raw_bytes,omitempty"` // bytes read from the file for this event, including EOLs
+  Line     uint64  `json:"line,omitempty"`
+  Text     *string `json:"text,omitempty"`
+  Fields   *map[string]string
+  Decoded  map[string]interface{} `json:"decoded,omitempty"` // keys decoded from a JSON line
+
+  Truncated bool `json:"truncated,omitempty"` // part of Text was dropped to honour max line bytes or max lines
+  Dropped   bool `json:"dropped,omitempty"`   // lines were filtered out, only the offset is passed to the registrar
+  Finished  bool `json:"finished,omitempty"`  // a compressed file was read to the end, only passed to the registrar
 
   fileinfo *os.FileInfo
+  ids      *FileState // inode and device of the file, for events read back from the disk queue
+}
+
+// Return true if the event only carries state for the registrar, and is not
+// to be published.
+func (e *FileEvent) isMarker() bool {
+  return e.Dropped || e.Finished
+}
+
+// Return roughly how many bytes the event takes to send, before compression.
+func (e *FileEvent) size() int {
+  if e.isMarker() {
+    return 0
+  }
+  size := 0
+  if e.Source != nil {
+    size += len(*e.Source)
+  }
+  if e.Text != nil {
+    size += len(*e.Text)
+  }
+  if e.Fields != nil {
+    for k, v := range *e.Fields {
+      size += len(k) + len(v)
+    }
+  }
+  for k, v := range e.Decoded {
+    size += len(k)
+    switch v := v.(type) {
+    case string:
+      size += len(v)
+    case json.Number:
+      size += len(v)
+    default:
+      // Objects, arrays and the like are sent as JSON
+      encoded, _ := json.Marshal(v)
+      size += len(encoded)
+    }
+  }
+  return size
 }
@@ -5,5 +5,6 @@ type FileState struct {
   Offset int64 `json:"offset,omitempty"`
   Inode uint64 `json:"inode,omitempty"`
   Device int32 `json:"device,omitempty"`
+  Finished bool `json:"finished,omitempty"`
 }
 
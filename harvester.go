@@ -3,9 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os" // for File and friends
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -15,59 +20,237 @@ type Harvester struct {
 	Offset     int64
 	FinishChan chan int64
 
-	file *os.File /* the file being watched */
+	file      *os.File      /* the file being watched */
+	codec     *codec        /* the character encoding of the file */
+	discarded int           /* bytes of the current line dropped beyond max line bytes */
+	backoff   time.Duration /* the last sleep waiting for data at EOF */
+
+	compressed bool /* the file is gzip compressed, and Offset is into the uncompressed data */
+
+	stop   chan struct{} /* closed to stop harvesting */
+	finish chan struct{} /* closed to stop at the end of the file, once it was compressed */
+	last   *FileEvent    /* the last event shipped downstream */
 }
 
+// Returned by readline when the harvester is stopped while waiting for data.
+var errHarvesterStopped = errors.New("harvester stopped")
+
 func (h *Harvester) Harvest(output chan *FileEvent) {
-	h.open()
+	h.compressed = h.FileConfig.isCompressed(h.Path)
+
+	// On completion, push offset so we can continue where we left off if we relaunch on the same file
+	defer func() { h.FinishChan <- h.Offset }()
+
+	if h.open() == nil {
+		return
+	}
 	info, e := h.file.Stat()
 	if e != nil {
 		panic(fmt.Sprintf("Harvest: unexpected error: %s", e.Error()))
 	}
-	defer h.file.Close()
+	// Stdin stays open for the prospector of a reloaded config to read
+	if h.Path != "-" {
+		defer h.file.Close()
+	}
 
-	// On completion, push offset so we can continue where we left off if we relaunch on the same file
-	defer func() { h.FinishChan <- h.Offset }()
+	// Tell the registrar a compressed file is done with, so it is not read
+	// again, even if it could not be read to the end
+	finished := func() {
+		h.send(output, &FileEvent{
+			Source:   &h.Path,
+			Offset:   h.Offset,
+			Finished: true,
+			Fields:   &h.FileConfig.Fields,
+			fileinfo: &info,
+		})
+	}
 
 	var line uint64 = 0 // Ask registrar about the line number
 
-	// get current offset in file
-	offset, _ := h.file.Seek(0, os.SEEK_CUR)
+	h.codec = h.FileConfig.codec
+	if h.codec == nil {
+		h.codec = plainCodec
+	}
 
-	if h.Offset > 0 {
-		emit("harvest: %q position:%d (offset snapshot:%d)\n", h.Path, h.Offset, offset)
-	} else if options.tailOnRotate {
-		emit("harvest: (tailing) %q (offset snapshot:%d)\n", h.Path, offset)
+	var reader *bufio.Reader
+	if h.compressed {
+		gz, err := gzip.NewReader(h.file)
+		if err != nil {
+			emit("Failed to read gzip compressed file %s: %s\n", h.Path, err)
+			finished()
+			return
+		}
+		defer gz.Close()
+		reader = bufio.NewReaderSize(gz, options.harvesterBufferSize)
+
+		// There is no seeking in a compressed file, so skip what we have read,
+		// looking at the byte order mark on the way past
+		emit("harvest: (gzip) %q position:%d\n", h.Path, h.Offset)
+		if h.Offset > 0 {
+			var skipped int
+			h.codec, skipped, _ = h.codec.skipBOM(reader)
+			if _, err = reader.Discard(int(h.Offset) - skipped); err != nil {
+				emit("Failed to skip to position %d of gzip compressed file %s: %s\n", h.Offset, h.Path, err)
+				finished()
+				return
+			}
+		}
 	} else {
-		emit("harvest: %q (offset snapshot:%d)\n", h.Path, offset)
-	}
+		// get current offset in file
+		offset, _ := h.file.Seek(0, os.SEEK_CUR)
+
+		if h.Offset > 0 {
+			emit("harvest: %q position:%d (offset snapshot:%d)\n", h.Path, h.Offset, offset)
+		} else if options.tailOnRotate {
+			emit("harvest: (tailing) %q (offset snapshot:%d)\n", h.Path, offset)
+		} else {
+			emit("harvest: %q (offset snapshot:%d)\n", h.Path, offset)
+		}
 
-	h.Offset = offset
+		h.Offset = offset
 
-	reader := bufio.NewReaderSize(h.file, options.harvesterBufferSize) // 16kb buffer by default
+		if h.Offset > 0 {
+			// Not reading from the start, so look back for the byte order mark
+			h.codec = h.codec.resolve(h.file)
+		}
+
+		reader = bufio.NewReaderSize(h.file, options.harvesterBufferSize) // 16kb buffer by default
+	}
 	buffer := new(bytes.Buffer)
 
-	var read_timeout = 10 * time.Second
+	var ml *multiline
+	if h.FileConfig.Multiline != nil {
+		ml = newMultiline(h.FileConfig.Multiline)
+	}
+
+	// Lines dropped by the line filters since the last event we shipped
+	var dropped *harvestedLine
+
+	ship := func(harvested *harvestedLine) {
+		if harvested == nil {
+			return
+		}
+		if !h.keep(harvested.text) {
+			if dropped == nil {
+				dropped = &harvestedLine{offset: harvested.offset}
+			}
+			dropped.length = harvested.offset + harvested.length - dropped.offset
+			return
+		}
+		// The registrar will record an offset past the dropped lines when
+		// it records this event
+		dropped = nil
+
+		line++
+		event := &FileEvent{
+			Source:    &h.Path,
+			Offset:    harvested.offset,
+			RawBytes:  harvested.length,
+			Line:      line,
+			Text:      &harvested.text,
+			Truncated: harvested.truncated,
+			Fields:    &h.FileConfig.Fields,
+			fileinfo:  &info,
+		}
+		if h.FileConfig.JSON != nil {
+			h.decodeJSON(event)
+		}
+
+		h.send(output, event) // ship the new event downstream
+	}
+
+	// If nothing was shipped since lines were dropped, send their offset on
+	// to the registrar so they are not read again
+	shipDropped := func() {
+		if dropped == nil {
+			return
+		}
+		h.send(output, &FileEvent{
+			Source:   &h.Path,
+			Offset:   dropped.offset,
+			RawBytes: dropped.length,
+			Dropped:  true,
+			Fields:   &h.FileConfig.Fields,
+			fileinfo: &info,
+		})
+		dropped = nil
+	}
+
 	last_read_time := time.Now()
 	for {
-		text, bytesread, err := h.readline(reader, buffer, read_timeout)
+		// Lines read but not shipped are read again on restart, as the
+		// registrar never heard of them
+		if h.stopped() {
+			emit("Stopping harvest of %s\n", h.Path)
+			shipDropped()
+			return
+		}
+
+		timeout := h.FileConfig.idleTimeout
+		if ml != nil && ml.pending() && ml.config.timeout < timeout {
+			// Wake up in time to flush a multiline event nothing more was added to
+			timeout = ml.config.timeout
+		}
+
+		harvested, err := h.readline(reader, buffer, timeout)
 
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF && h.compressed {
+				// Read the whole file, ship what is left and tell the
+				// registrar it is finished
+				if buffer.Len() != 0 {
+					last := h.takeLine(buffer)
+					h.Offset += last.length
+					if ml != nil {
+						last = ml.add(last)
+					}
+					ship(last)
+				}
+				if ml != nil {
+					ship(ml.flush())
+				}
+				emit("Finished harvest of compressed file %s\n", h.Path)
+				finished()
+				return
+			} else if err == io.EOF {
 				// timed out waiting for data, got eof.
+				// Ship any multiline event that has waited long enough for more lines
+				if ml != nil && ml.expired() {
+					ship(ml.flush())
+				}
+				shipDropped()
+
 				// Check to see if the file was truncated
 				info, _ := h.file.Stat()
 				if info.Size() < h.Offset {
 					emit("File truncated, seeking to beginning: %s\n", h.Path)
+					if ml != nil {
+						ship(ml.flush())
+					}
+					shipDropped()
 					h.file.Seek(0, os.SEEK_SET)
 					h.Offset = 0
+				} else if h.finishing() {
+					// The rest of the file is read from its compressed copy
+					emit("Stopping harvest of %s, as it was compressed\n", h.Path)
+					if ml != nil {
+						ship(ml.flush())
+					}
+					shipDropped()
+					return
 				} else if age := time.Since(last_read_time); age > h.FileConfig.deadtime {
 					// if last_read_time was more than dead time, this file is probably
 					// dead. Stop watching it.
 					emit("Stopping harvest of %s; last change was %v ago\n", h.Path, age)
+					if ml != nil {
+						ship(ml.flush())
+					}
+					shipDropped()
 					return
 				}
 				continue
+			} else if err == errHarvesterStopped {
+				continue
 			} else {
 				emit("Unexpected state reading from %s; error: %s\n", h.Path, err)
 				return
@@ -75,18 +258,16 @@ func (h *Harvester) Harvest(output chan *FileEvent) {
 		}
 		last_read_time = time.Now()
 
-		line++
-		event := &FileEvent{
-			Source:   &h.Path,
-			Offset:   h.Offset,
-			Line:     line,
-			Text:     text,
-			Fields:   &h.FileConfig.Fields,
-			fileinfo: &info,
+		h.Offset += harvested.length
+
+		if harvested.truncated {
+			emit("Truncated a line longer than %d bytes at offset %d of %s\n", h.FileConfig.MaxLineBytes, harvested.offset, h.Path)
 		}
-		h.Offset += int64(bytesread)
 
-		output <- event // ship the new event downstream
+		if ml != nil {
+			harvested = ml.add(harvested)
+		}
+		ship(harvested)
 	} /* forever */
 }
 
@@ -102,9 +283,11 @@ func (h *Harvester) open() *os.File {
 		h.file, err = os.Open(h.Path)
 
 		if err != nil {
-			// retry on failure.
+			// retry on failure, except for compressed files, which are read once
 			emit("Failed opening %s: %s\n", h.Path, err)
-			time.Sleep(5 * time.Second)
+			if h.compressed || !h.sleep(5*time.Second) {
+				return nil
+			}
 		} else {
 			break
 		}
@@ -113,7 +296,9 @@ func (h *Harvester) open() *os.File {
 	// Check we are not following a rabbit hole (symlinks, etc.)
 	mustBeRegularFile(h.file) // panics
 
-	if h.Offset > 0 {
+	if h.compressed {
+		// Harvest will skip to the offset in the uncompressed data
+	} else if h.Offset > 0 {
 		h.file.Seek(h.Offset, os.SEEK_SET)
 	} else if options.tailOnRotate {
 		h.file.Seek(0, os.SEEK_END)
@@ -124,58 +309,215 @@ func (h *Harvester) open() *os.File {
 	return h.file
 }
 
-func (h *Harvester) readline(reader *bufio.Reader, buffer *bytes.Buffer, eof_timeout time.Duration) (*string, int, error) {
+func (h *Harvester) readline(reader *bufio.Reader, buffer *bytes.Buffer, eof_timeout time.Duration) (*harvestedLine, error) {
 	var is_partial bool = true
-	var newline_length int = 1
 	start_time := time.Now()
 
+	// Room for the longest line we keep, plus its EOL chars (CRLF)
+	max_buffered := h.FileConfig.MaxLineBytes + len(h.codec.carriage) + len(h.codec.newline)
+
 	for {
-		segment, err := reader.ReadBytes('\n')
+		var segment []byte
+		var err error
+
+		if h.Offset == 0 && buffer.Len() == 0 && h.discarded == 0 {
+			// At the start of the file, skip any byte order mark
+			var skipped int
+			if h.codec, skipped, err = h.codec.skipBOM(reader); err == nil {
+				h.Offset += int64(skipped)
+				segment, err = h.codec.readSegment(reader)
+			}
+		} else {
+			segment, err = h.codec.readSegment(reader)
+		}
 
 		if segment != nil && len(segment) > 0 {
-			if segment[len(segment)-1] == '\n' {
+			// Data arrived, so check again quickly next time we run out
+			h.backoff = 0
+
+			if h.codec.endsLine(segment) {
 				// Found a complete line
 				is_partial = false
+			}
 
-				// Check if also a CR present
-				if len(segment) > 1 && segment[len(segment)-2] == '\r' {
-					newline_length++
+			// Keep what fits, discard the rest of the line until the next newline
+			if keep := max_buffered - buffer.Len(); keep < len(segment) {
+				if keep > 0 {
+					buffer.Write(segment[:keep])
 				}
+				h.discarded += len(segment) - keep
+			} else {
+				buffer.Write(segment)
 			}
-
-			// TODO(sissel): if buffer exceeds a certain length, maybe report an error condition? chop it?
-			buffer.Write(segment)
 		}
 
 		if err != nil {
-			if err == io.EOF && is_partial {
-				time.Sleep(1 * time.Second) // TODO(sissel): Implement backoff
+			if err == bufio.ErrBufferFull {
+				// Line longer than the reader's buffer, keep reading it
+				continue
+			} else if err == io.EOF && is_partial {
+				if h.compressed {
+					// Compressed files are complete, there is no more to wait for
+					return nil, err
+				}
+
+				if !h.sleep(h.nextBackoff()) {
+					return nil, errHarvesterStopped
+				}
 
 				// Give up waiting for data after a certain amount of time.
 				// If we time out, return the error (eof)
 				if time.Since(start_time) > eof_timeout {
-					return nil, 0, err
+					return nil, err
 				}
 				continue
 			} else {
 				emit("error: Harvester.readLine: %s", err.Error())
-				return nil, 0, err // TODO(sissel): don't do this?
+				return nil, err // TODO(sissel): don't do this?
 			}
 		}
 
 		// If we got a full line, return the whole line without the EOL chars (CRLF or LF)
 		if !is_partial {
-			// Get the str length with the EOL chars (LF or CRLF)
-			bufferSize := buffer.Len()
-			str := new(string)
-			*str = buffer.String()[:bufferSize-newline_length]
-			// Reset the buffer for the next line
-			buffer.Reset()
-			return str, bufferSize, nil
+			return h.takeLine(buffer), nil
 		}
 	} /* forever read chunks */
+}
+
+// Return the line in the buffer, decoded and truncated to max line bytes,
+// and reset the buffer for the next line.
+func (h *Harvester) takeLine(buffer *bytes.Buffer) *harvestedLine {
+	line := &harvestedLine{
+		offset: h.Offset,
+		length: int64(buffer.Len() + h.discarded),
+	}
+
+	text := buffer.Bytes()
+	if h.discarded == 0 {
+		text = h.codec.trimEOL(text)
+	}
+	if h.discarded != 0 || len(text) > h.FileConfig.MaxLineBytes {
+		// Keep whole code units only
+		text = text[:h.FileConfig.MaxLineBytes-h.FileConfig.MaxLineBytes%h.codec.unit]
+		line.truncated = true
+	}
+	line.text = h.codec.decode(text)
+
+	// Reset the buffer for the next line
+	buffer.Reset()
+	h.discarded = 0
+	return line
+}
+
+// Decode the event's line as a JSON object, whose keys are published
+// alongside (or, if configured, in place of) the usual ones.
+func (h *Harvester) decodeJSON(event *FileEvent) {
+	config := h.FileConfig.JSON
+
+	// Keep numbers as they were written, rather than as float64
+	decoder := json.NewDecoder(strings.NewReader(*event.Text))
+	decoder.UseNumber()
+
+	var decoded map[string]interface{}
+	err := decoder.Decode(&decoded)
+	if err == nil && decoded == nil {
+		err = fmt.Errorf("not a JSON object")
+	}
+	if err == nil {
+		var extra json.RawMessage
+		if decoder.Decode(&extra) != io.EOF {
+			err = fmt.Errorf("unexpected data after the JSON object")
+		}
+	}
+	if err != nil {
+		event.Decoded = map[string]interface{}{config.ErrorKey: err.Error()}
+		return
+	}
+
+	// The message becomes the line
+	if message, ok := decoded[config.MessageKey].(string); ok {
+		event.Text = &message
+		delete(decoded, config.MessageKey)
+	}
+
+	if !config.OverwriteKeys {
+		for _, key := range []string{"file", "host", "offset", "line", "truncated"} {
+			delete(decoded, key)
+		}
+		for key := range h.FileConfig.Fields {
+			delete(decoded, key)
+		}
+	}
+
+	event.Decoded = decoded
+}
+
+// Return true if the line passes the "include lines" and "drop lines"
+// filters and should be shipped.
+func (h *Harvester) keep(text string) bool {
+	if len(h.FileConfig.includeLines) != 0 && !matchAny(h.FileConfig.includeLines, text) {
+		return false
+	}
+	return !matchAny(h.FileConfig.dropLines, text)
+}
+
+func matchAny(patterns []*regexp.Regexp, text string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return how long to sleep waiting for more data at EOF. Each consecutive
+// sleep is longer, up to the configured max, until data arrives.
+func (h *Harvester) nextBackoff() time.Duration {
+	config := h.FileConfig.Backoff
+	if h.backoff == 0 {
+		h.backoff = config.min
+	} else if h.backoff = time.Duration(float64(h.backoff) * config.Multiplier); h.backoff > config.max {
+		h.backoff = config.max
+	}
+	return h.backoff
+}
+
+// Send an event downstream, unless the harvester is stopped first.
+func (h *Harvester) send(output chan *FileEvent, event *FileEvent) {
+	select {
+	case output <- event:
+		h.last = event
+	case <-h.stop:
+	}
+}
+
+// Sleep for d, returning false if the harvester was stopped instead.
+func (h *Harvester) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-h.stop:
+		return false
+	}
+}
 
-	return nil, 0, nil
+// Whether the harvester was asked to stop once it reaches the end of the file.
+func (h *Harvester) finishing() bool {
+	select {
+	case <-h.finish:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *Harvester) stopped() bool {
+	select {
+	case <-h.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 // panics
@@ -189,6 +531,6 @@ func mustBeRegularFile(f *os.File) {
 	}
 
 	if !info.Mode().IsRegular() {
-		panic(fmt.Errorf("Harvester: not a regular file:%q", info.Mode(), info.Name()))
+		panic(fmt.Errorf("Harvester: not a regular file:%q (mode %v)", info.Name(), info.Mode()))
 	}
 }
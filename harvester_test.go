@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestReadlineMaxLineBytes(t *testing.T) {
+	input := "short\r\n" + strings.Repeat("x", 100) + "\n" + "12345678\r\n" + "after\n"
+	// Use a reader buffer smaller than the long line to exercise ReadSlice
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+	buffer := new(bytes.Buffer)
+	h := &Harvester{Path: "test", FileConfig: FileConfig{MaxLineBytes: 8}, codec: plainCodec}
+
+	expected := []harvestedLine{
+		{text: "short", offset: 0, length: 7},
+		{text: "xxxxxxxx", offset: 7, length: 101, truncated: true},
+		{text: "12345678", offset: 108, length: 10},
+		{text: "after", offset: 118, length: 6},
+	}
+
+	for _, want := range expected {
+		line, err := h.readline(reader, buffer, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error from readline: %s", err)
+		}
+		if *line != want {
+			t.Fatalf("Expected %v, got %v", want, *line)
+		}
+		h.Offset += line.length
+	}
+}
+
+func encodeUTF16LE(text string) []byte {
+	var encoded []byte
+	for _, unit := range utf16.Encode([]rune(text)) {
+		encoded = append(encoded, byte(unit), byte(unit>>8))
+	}
+	return encoded
+}
+
+func TestReadlineEncodings(t *testing.T) {
+	tests := []struct {
+		encoding string
+		input    []byte
+		expected []harvestedLine
+	}{
+		{
+			encoding: "utf-16",
+			input:    append([]byte{0xff, 0xfe}, encodeUTF16LE("h\u00e9llo\r\n\u010a\U0001f600\n")...),
+			expected: []harvestedLine{
+				{text: "h\u00e9llo", offset: 2, length: 14},
+				// U+010A encodes as 0x0a 0x01, which must not be taken as a newline
+				{text: "\u010a\U0001f600", offset: 16, length: 8},
+			},
+		},
+		{
+			encoding: "latin1",
+			input:    []byte("caf\xe9\n\xa9 2015\n"),
+			expected: []harvestedLine{
+				{text: "caf\u00e9", offset: 0, length: 5},
+				{text: "\u00a9 2015", offset: 5, length: 7},
+			},
+		},
+		{
+			encoding: "shift_jis",
+			input:    []byte("\x83\x8d\x83\x4f: \x83\x47\x83\x89\x81\x5b\x82\xa0\xb1\n\x83\x5c\x82\n"),
+			expected: []harvestedLine{
+				{text: "\u30ed\u30b0: \u30a8\u30e9\u30fc\u3042\uff71", offset: 0, length: 16},
+				// A trail byte may be "\\", and a lead byte without one is invalid
+				{text: "\u30bd\ufffd", offset: 16, length: 4},
+			},
+		},
+		{
+			encoding: "utf-8",
+			input:    []byte("\xef\xbb\xbfbom\n"),
+			expected: []harvestedLine{
+				{text: "bom", offset: 3, length: 4},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c, err := findCodec(test.encoding)
+		chkerr(t, err)
+
+		reader := bufio.NewReaderSize(bytes.NewReader(test.input), 16)
+		buffer := new(bytes.Buffer)
+		h := &Harvester{Path: "test", FileConfig: FileConfig{MaxLineBytes: 100}, codec: c}
+
+		for _, want := range test.expected {
+			line, err := h.readline(reader, buffer, 0)
+			if err != nil {
+				t.Fatalf("%s: unexpected error from readline: %s", test.encoding, err)
+			}
+			if *line != want {
+				t.Fatalf("%s: expected %v, got %v", test.encoding, want, *line)
+			}
+			h.Offset += line.length
+		}
+	}
+
+	if _, err := findCodec("klingon"); err == nil {
+		t.Fatalf("Expected an error for an unsupported encoding")
+	}
+}
+
+func TestHarvesterBackoff(t *testing.T) {
+	backoff := &BackoffConfig{Min: "100ms", Max: "1s", Multiplier: 3}
+	chkerr(t, loadBackoffConfig("harvester backoff", backoff, defaultConfig.backoffMin, defaultConfig.backoffMax))
+	h := &Harvester{Path: "test", FileConfig: FileConfig{Backoff: backoff}}
+
+	expected := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second}
+	for _, want := range expected {
+		if got := h.nextBackoff(); got != want {
+			t.Fatalf("Expected backoff of %v, got %v", want, got)
+		}
+	}
+
+	// Data arriving resets the backoff
+	reader := bufio.NewReader(strings.NewReader("data\n"))
+	h.FileConfig.MaxLineBytes = 100
+	h.codec = plainCodec
+	h.Offset = 1
+	if _, err := h.readline(reader, new(bytes.Buffer), 0); err != nil {
+		t.Fatalf("Unexpected error from readline: %s", err)
+	}
+	if got := h.nextBackoff(); got != backoff.min {
+		t.Fatalf("Expected backoff to reset to %v after data arrived, got %v", backoff.min, got)
+	}
+}
+
+func TestHarvesterLineFilters(t *testing.T) {
+	h := &Harvester{Path: "test", FileConfig: FileConfig{
+		IncludeLines: []string{"^ERROR", "^WARN"},
+		DropLines:    []string{"healthcheck"},
+	}}
+	chkerr(t, loadFileConfig(&h.FileConfig))
+
+	tests := map[string]bool{
+		"ERROR something broke":      true,
+		"WARN something might break": true,
+		"DEBUG noise":                false,
+		"WARN healthcheck slow":      false,
+	}
+	for text, expected := range tests {
+		if h.keep(text) != expected {
+			t.Errorf("Expected keep(%q) to be %t", text, expected)
+		}
+	}
+}
+
+func TestHarvestGzip(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	file := filepath.Join(tmpdir, "app.log.1.gz")
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("one\ntwo\nthree"))
+	gz.Close()
+	chkerr(t, ioutil.WriteFile(file, compressed.Bytes(), 0644))
+
+	harvest := func(offset int64) (events []*FileEvent) {
+		fileconfig := FileConfig{Gzip: true}
+		chkerr(t, loadFileConfig(&fileconfig))
+
+		output := make(chan *FileEvent, 10)
+		h := &Harvester{Path: file, FileConfig: fileconfig, Offset: offset, FinishChan: make(chan int64, 1)}
+		h.Harvest(output)
+		close(output)
+
+		for event := range output {
+			events = append(events, event)
+		}
+		return events
+	}
+
+	events := harvest(0)
+	if len(events) != 4 {
+		t.Fatalf("Expected 3 lines and a finished marker, got %d events", len(events))
+	}
+	for i, text := range []string{"one", "two", "three"} {
+		if *events[i].Text != text || events[i].isMarker() {
+			t.Errorf("Expected event %d to be %q, got %q", i, text, *events[i].Text)
+		}
+	}
+	if last := events[3]; !last.Finished || last.Offset != 13 {
+		t.Errorf("Expected a finished marker at offset 13, got %v", last)
+	}
+
+	// Resuming skips what was already read
+	events = harvest(4)
+	if len(events) != 3 || *events[0].Text != "two" || events[0].Offset != 4 {
+		t.Errorf("Expected resuming at offset 4 to start at \"two\", got %v", events)
+	}
+}
+
+func TestHarvestGzipUnreadable(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	fileconfig := FileConfig{Gzip: true}
+	chkerr(t, loadFileConfig(&fileconfig))
+	harvest := func(file string) (events []*FileEvent, offset int64) {
+		output := make(chan *FileEvent, 10)
+		h := &Harvester{Path: file, FileConfig: fileconfig, FinishChan: make(chan int64, 1)}
+		h.Harvest(output)
+		close(output)
+
+		for event := range output {
+			events = append(events, event)
+		}
+		return events, <-h.FinishChan
+	}
+
+	// A file that is not gzip compressed is finished with, not read again
+	corrupt := filepath.Join(tmpdir, "corrupt.log.gz")
+	chkerr(t, ioutil.WriteFile(corrupt, []byte("not compressed\n"), 0644))
+	events, offset := harvest(corrupt)
+	if len(events) != 1 || !events[0].Finished || offset != 0 {
+		t.Errorf("Expected a finished marker for a file that can't be decompressed, got %v", events)
+	}
+
+	// A file that can't be opened is given up on
+	events, offset = harvest(filepath.Join(tmpdir, "missing.log.gz"))
+	if len(events) != 0 || offset != 0 {
+		t.Errorf("Expected nothing harvested from a file that can't be opened, got %v", events)
+	}
+}
+
+func TestHarvesterDecodeJSON(t *testing.T) {
+	h := &Harvester{Path: "test", FileConfig: FileConfig{
+		Fields: map[string]string{"type": "app"},
+		JSON:   &JSONConfig{MessageKey: "msg"},
+	}}
+	chkerr(t, loadFileConfig(&h.FileConfig))
+
+	decode := func(text string) *FileEvent {
+		event := &FileEvent{Source: &h.Path, Text: &text, Fields: &h.FileConfig.Fields}
+		h.decodeJSON(event)
+		return event
+	}
+
+	event := decode(`{"msg": "hello", "level": "info", "count": 3, "type": "other", "host": "elsewhere"}`)
+	if *event.Text != "hello" {
+		t.Errorf("Expected the message key to become the line, got %q", *event.Text)
+	}
+	expected := map[string]interface{}{"level": "info", "count": json.Number("3")}
+	if !reflect.DeepEqual(event.Decoded, expected) {
+		t.Errorf("Expected decoded keys %v, got %v", expected, event.Decoded)
+	}
+
+	event = decode(`not json`)
+	if *event.Text != "not json" || event.Decoded["json_error"] == nil {
+		t.Errorf("Expected a json_error key and the line kept on a decode failure, got %v", event.Decoded)
+	}
+
+	event = decode(`{"msg": "hello"} trailing`)
+	if *event.Text != `{"msg": "hello"} trailing` || event.Decoded["json_error"] == nil {
+		t.Errorf("Expected a json_error key and the line kept with data after the object, got %v", event.Decoded)
+	}
+	event = decode(`{"msg": "hello"}  `)
+	if *event.Text != "hello" {
+		t.Errorf("Expected whitespace after the object to be allowed, got %v", event.Decoded)
+	}
+
+	h.FileConfig.JSON.OverwriteKeys = true
+	event = decode(`{"msg": "hello", "type": "other", "host": "elsewhere"}`)
+	pairs := make(map[string]interface{})
+	for _, pair := range eventPairs(event) {
+		if _, seen := pairs[pair.key]; seen {
+			t.Errorf("Expected key %s to be published once", pair.key)
+		}
+		pairs[pair.key] = pair.value
+	}
+	if pairs["type"] != "other" || pairs["host"] != "elsewhere" || pairs["line"] != "hello" {
+		t.Errorf("Expected decoded keys to overwrite the others, got %v", pairs)
+	}
+}
+
+func TestHarvesterDecodeJSONMessageKey(t *testing.T) {
+	h := &Harvester{Path: "test", FileConfig: FileConfig{JSON: &JSONConfig{}}}
+	chkerr(t, loadFileConfig(&h.FileConfig))
+
+	text := `{"message": "hello", "level": "info"}`
+	event := &FileEvent{Source: &h.Path, Text: &text}
+	h.decodeJSON(event)
+	if *event.Text != "hello" || event.Decoded["message"] != nil {
+		t.Errorf("Expected the \"message\" key to become the line by default, got %q and %v", *event.Text, event.Decoded)
+	}
+}
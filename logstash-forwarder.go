@@ -1,11 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"syscall"
 	"time"
   "fmt"
 )
@@ -21,25 +22,33 @@ var exitStat = struct {
 var options = &struct {
 	configArg           string
 	spoolSize           uint64
+	spoolMaxBytes       uint64
 	harvesterBufferSize int
 	cpuProfileFile      string
+	metricsAddress      string
 	idleTimeout         time.Duration
+	drainTimeout        time.Duration
 	useSyslog           bool
 	tailOnRotate        bool
 	quiet               bool
+	configTest          bool
   version bool
 }{
 	spoolSize:           1024,
 	harvesterBufferSize: 16 << 10,
 	idleTimeout:         time.Second * 5,
+	drainTimeout:        time.Second * 10,
 }
 
 func emitOptions() {
 	emit("\t--- options -------\n")
 	emit("\tconfig-arg:          %s\n", options.configArg)
 	emit("\tidle-timeout:        %v\n", options.idleTimeout)
+	emit("\tdrain-timeout:       %v\n", options.drainTimeout)
 	emit("\tspool-size:          %d\n", options.spoolSize)
+	emit("\tspool-max-bytes:     %d\n", options.spoolMaxBytes)
 	emit("\tharvester-buff-size: %d\n", options.harvesterBufferSize)
+	emit("\tmetrics:             %s\n", options.metricsAddress)
 	emit("\t--- flags ---------\n")
 	emit("\ttail (on-rotation):  %t\n", options.tailOnRotate)
 	emit("\tlog-to-syslog:          %t\n", options.useSyslog)
@@ -65,8 +74,13 @@ func init() {
 
 	flag.StringVar(&options.cpuProfileFile, "cpuprofile", options.cpuProfileFile, "path to cpu profile output - note: exits on profile end.")
 
+	flag.StringVar(&options.metricsAddress, "metrics", options.metricsAddress, "host:port to serve metrics on, at /debug/vars")
+
 	flag.Uint64Var(&options.spoolSize, "spool-size", options.spoolSize, "event count spool threshold - forces network flush")
 	flag.Uint64Var(&options.spoolSize, "sv", options.spoolSize, "event count spool threshold - forces network flush")
+	flag.Uint64Var(&options.spoolMaxBytes, "spool-max-bytes", options.spoolMaxBytes, "uncompressed event bytes spool threshold - forces network flush, 0 for no limit")
+
+	flag.DurationVar(&options.drainTimeout, "drain-timeout", options.drainTimeout, "how long to wait for events to be acknowledged when stopping")
 
 	flag.IntVar(&options.harvesterBufferSize, "harvest-buffer-size", options.harvesterBufferSize, "harvester reader buffer size")
 	flag.IntVar(&options.harvesterBufferSize, "hb", options.harvesterBufferSize, "harvester reader buffer size")
@@ -78,6 +92,7 @@ func init() {
 	flag.BoolVar(&options.tailOnRotate, "t", options.tailOnRotate, "always tail on log rotation -note: may skip entries ")
 
 	flag.BoolVar(&options.quiet, "quiet", options.quiet, "operate in quiet mode - only emit errors to log")
+	flag.BoolVar(&options.configTest, "configtest", options.configTest, "check the config files, print the merged config and exit")
 	flag.BoolVar(&options.version, "version", options.version, "output the version of this program")
 }
 
@@ -106,6 +121,11 @@ func main() {
 	}
 
 	assertRequiredOptions()
+	if options.configTest {
+		// Only the problems found and the config are of interest
+		options.quiet = true
+		configTest(options.configArg)
+	}
 	emitOptions()
 
 	if runProfiler() {
@@ -122,32 +142,23 @@ func main() {
 		}()
 	}
 
-	config_files, err := DiscoverConfigs(options.configArg)
-	if err != nil {
-		fault("Could not use -config of '%s': %s", options.configArg, err)
+	if options.metricsAddress != "" {
+		go serveMetrics(options.metricsAddress)
 	}
 
-	var config Config
-
-	for _, filename := range config_files {
-		additional_config, err := LoadConfig(filename)
-		if err == nil {
-			err = MergeConfig(&config, additional_config)
-		}
-		if err != nil {
-			fault("Could not load config file %s: %s", filename, err)
-		}
+	config, err := loadConfigs(options.configArg)
+	if err != nil {
+		fault("%s", err)
 	}
-	FinalizeConfig(&config)
+
+	// Stop gracefully on SIGTERM or SIGINT, and reload the config on SIGHUP
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
 
 	event_chan := make(chan *FileEvent, 16)
 	publisher_chan := make(chan []*FileEvent, 1)
 	registrar_chan := make(chan []*FileEvent, 1)
 
-	if len(config.Files) == 0 {
-		log.Fatalf("No paths given. What files do you want me to watch?\n")
-	}
-
 	// The basic model of execution:
 	// - prospector: finds files in paths/globs to harvest, starts harvesters
 	// - harvester: reads a file, sends events to the spooler
@@ -161,27 +172,22 @@ func main() {
 	restart.persist = make(chan *FileState)
 
 	// Load the previous log file locations now, for use in prospector
-	restart.files = make(map[string]*FileState)
-	if existing, e := os.Open(".logstash-forwarder"); e == nil {
-		defer existing.Close()
-		wd := ""
-		if wd, e = os.Getwd(); e != nil {
-			emit("WARNING: os.Getwd retuned unexpected error %s -- ignoring\n", e.Error())
+	restart.files = loadRegistry(".logstash-forwarder")
+
+	// Events already queued on disk are not read again, but the registrar
+	// only records them once they are acknowledged
+	var queue *diskQueue
+	var acknowledged map[*FileState]*FileState
+	if config.Queue.Path != "" {
+		if queue, err = openQueue(&config.Queue); err != nil {
+			fault("Could not open the queue in %s: %s", config.Queue.Path, err)
 		}
-		emit("Loading registrar data from %s/.logstash-forwarder\n", wd)
-
-		decoder := json.NewDecoder(existing)
-		decoder.Decode(&restart.files)
+		acknowledged = queue.resume(restart.files)
 	}
 
-	pendingProspectorCnt := 0
-
 	// Prospect the globs/paths given on the command line and launch harvesters
-	for _, fileconfig := range config.Files {
-		prospector := &Prospector{FileConfig: fileconfig}
-		go prospector.Prospect(restart, event_chan)
-		pendingProspectorCnt++
-	}
+	harvesting := newHarvesting(config, event_chan)
+	pendingProspectorCnt := harvesting.start(config.Files, restart)
 
 	// Now determine which states we need to persist by pulling the events from the prospectors
 	// When we hit a nil source a prospector had finished so we decrease the expected events
@@ -196,19 +202,85 @@ func main() {
 			}
 			continue
 		}
+		if acked, queued := acknowledged[event]; queued {
+			if acked == nil {
+				continue
+			}
+			acked.Source = event.Source
+			event = acked
+		}
 		persist[*event.Source] = event
 		emit("Registrar will re-save state for %s\n", *event.Source)
 	}
 
 	emit("All prospectors initialised with %d states to persist\n", len(persist))
 
+	// With a queue, the spooler feeds the queue, which feeds the publisher,
+	// and acknowledged events go back through the queue to the registrar
+	spool_chan, ack_chan := publisher_chan, registrar_chan
+	if queue != nil {
+		spool_chan = make(chan []*FileEvent, 1)
+		ack_chan = make(chan []*FileEvent, 1)
+		go queue.run(spool_chan, publisher_chan, ack_chan, registrar_chan)
+	}
+
 	// Harvesters dump events into the spooler.
-	go Spool(event_chan, publisher_chan, options.spoolSize, options.idleTimeout)
+	spool_stop := make(chan struct{})
+	go Spool(event_chan, spool_chan, options.spoolSize, options.spoolMaxBytes, options.idleTimeout, spool_stop)
 
-	go Publishv1(publisher_chan, registrar_chan, &config.Network)
+	// The publisher returns once the spooler stops and everything it was
+	// given is acknowledged
+	go Publish(publisher_chan, ack_chan, &config.Network, harvesting.reconnect)
 
 	// registrar records last acknowledged positions in all files.
-	Registrar(persist, registrar_chan)
+	registrar_stop := make(chan struct{})
+	registrar_done := make(chan struct{})
+	go func() {
+		Registrar(persist, registrar_chan, registrar_stop)
+		close(registrar_done)
+	}()
+
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		emit("Received %v, reloading the config\n", sig)
+		if reloaded, err := loadConfigs(options.configArg); err != nil {
+			emit("Keeping the current config, as the new one failed to load: %s\n", err)
+		} else {
+			harvesting.reload(reloaded, ".logstash-forwarder")
+		}
+		sig = <-signals
+	}
+	emit("Received %v, stopping\n", sig)
+	drain := time.After(options.drainTimeout)
+
+	// Stop reading files, and publish what was read
+	go func() {
+		harvesting.stop()
+		close(spool_stop)
+	}()
+
+	// Only another SIGTERM or SIGINT cuts the wait short, as SIGHUP may come
+	// from log rotation
+	for waiting := true; waiting; {
+		select {
+		case <-registrar_done:
+			emit("Every event was acknowledged\n")
+			waiting = false
+		case <-drain:
+			emit("Gave up waiting for events to be acknowledged after %v\n", options.drainTimeout)
+			waiting = false
+		case sig = <-signals:
+			if sig == syscall.SIGHUP {
+				emit("Received %v while stopping, ignoring it\n", sig)
+				continue
+			}
+			emit("Received %v again, not waiting for events to be acknowledged\n", sig)
+			waiting = false
+		}
+	}
+	close(registrar_stop)
+	<-registrar_done
+	exit(exitStat.ok, "Stopped")
 }
 
 // REVU: yes, this is a temp hack.
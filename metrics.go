@@ -0,0 +1,36 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Metrics are published with expvar, and served as JSON at /debug/vars on
+// the address given by -metrics.
+var (
+	tlsMetrics    = expvar.NewMap("tls")
+	tlsLastReload = new(expvar.String)
+	tlsLastError  = new(expvar.String)
+
+	publisherMetrics = expvar.NewMap("publisher")
+)
+
+func init() {
+	tlsMetrics.Set("last reload", tlsLastReload)
+	tlsMetrics.Set("last error", tlsLastError)
+}
+
+// Report the size of a window of events sent, before and after compression.
+func reportPayload(events int, uncompressed int, compressed int) {
+	publisherMetrics.Add("events", int64(events))
+	publisherMetrics.Add("bytes", int64(uncompressed))
+	publisherMetrics.Add("compressed bytes", int64(compressed))
+	emit("Sending %d events, %d bytes compressed to %d\n", events, uncompressed, compressed)
+}
+
+func serveMetrics(address string) {
+	emit("Serving metrics on http://%s/debug/vars\n", address)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		emit("Failed serving metrics: %s\n", err)
+	}
+}
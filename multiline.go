@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// A line, or a set of joined lines, ready to be shipped as a single event.
+type harvestedLine struct {
+	text   string
+	offset int64 // offset in the file of the first byte of the (first) line
+	length int64 // bytes read from the file, including all EOL chars
+
+	truncated bool // part of the text was dropped to honour a limit
+}
+
+// multiline joins continuation lines, as described by a MultilineConfig, into
+// a single event.
+type multiline struct {
+	config *MultilineConfig
+
+	lines     []string
+	offset    int64
+	length    int64
+	truncated bool
+	last_line time.Time
+}
+
+func newMultiline(config *MultilineConfig) *multiline {
+	return &multiline{config: config}
+}
+
+// Add a line read from the file and return any event that it completed, or
+// nil if more lines are needed.
+func (m *multiline) add(line *harvestedLine) (ready *harvestedLine) {
+	continuation := m.config.regexp.MatchString(line.text) != m.config.Negate
+
+	switch m.config.Match {
+	case "after":
+		// A non-continuation line starts a new event, so ship what we have
+		if !continuation {
+			ready = m.flush()
+		}
+		m.append(line)
+	case "before":
+		// A non-continuation line is the last line of the event
+		m.append(line)
+		if !continuation {
+			ready = m.flush()
+		}
+	}
+
+	return ready
+}
+
+func (m *multiline) append(line *harvestedLine) {
+	if len(m.lines) == 0 {
+		m.offset = line.offset
+	}
+	// Once max lines is reached further lines are dropped, but still counted
+	// in the length so the registrar does not read them again
+	if len(m.lines) < m.config.MaxLines {
+		m.lines = append(m.lines, line.text)
+	} else {
+		m.truncated = true
+	}
+	m.length += line.length
+	m.truncated = m.truncated || line.truncated
+	m.last_line = time.Now()
+}
+
+// Return true if lines are waiting for the event to be completed.
+func (m *multiline) pending() bool {
+	return len(m.lines) != 0
+}
+
+// Return true if the pending lines have waited longer than the flush timeout.
+func (m *multiline) expired() bool {
+	return m.pending() && time.Since(m.last_line) >= m.config.timeout
+}
+
+// Return the pending lines as one event and reset, or nil if nothing is
+// pending.
+func (m *multiline) flush() *harvestedLine {
+	if !m.pending() {
+		return nil
+	}
+
+	ready := &harvestedLine{
+		text:      strings.Join(m.lines, "\n"),
+		offset:    m.offset,
+		length:    m.length,
+		truncated: m.truncated,
+	}
+	m.lines = m.lines[:0]
+	m.length = 0
+	m.truncated = false
+	return ready
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+)
+
+func makeMultiline(t *testing.T, config MultilineConfig) *multiline {
+	if err := loadMultilineConfig(&config); err != nil {
+		t.Fatalf("Error loading multiline config: %s", err)
+	}
+	return newMultiline(&config)
+}
+
+// Feed lines of length len(line)+1 into m, returning what was shipped.
+func feedMultiline(m *multiline, lines []string) (shipped []*harvestedLine) {
+	var offset int64
+	for _, line := range lines {
+		if ready := m.add(&harvestedLine{text: line, offset: offset, length: int64(len(line) + 1)}); ready != nil {
+			shipped = append(shipped, ready)
+		}
+		offset += int64(len(line) + 1)
+	}
+	return shipped
+}
+
+func TestMultilineMatchAfter(t *testing.T) {
+	m := makeMultiline(t, MultilineConfig{Pattern: `^\s`})
+
+	shipped := feedMultiline(m, []string{
+		"Exception in thread \"main\" java.lang.NullPointerException",
+		"    at Main.run(Main.java:10)",
+		"    at Main.main(Main.java:5)",
+		"next event",
+	})
+
+	if len(shipped) != 1 {
+		t.Fatalf("Expected 1 event to be shipped, got %d", len(shipped))
+	}
+	expected := harvestedLine{
+		text:   "Exception in thread \"main\" java.lang.NullPointerException\n    at Main.run(Main.java:10)\n    at Main.main(Main.java:5)",
+		offset: 0,
+		length: 118,
+	}
+	if *shipped[0] != expected {
+		t.Fatalf("Expected %v, got %v", expected, *shipped[0])
+	}
+
+	last := m.flush()
+	if last == nil || last.text != "next event" || last.offset != 118 || last.length != 11 {
+		t.Fatalf("Expected the pending last line to flush at offset 118, got %v", last)
+	}
+	if m.pending() {
+		t.Fatalf("Expected nothing pending after flush")
+	}
+}
+
+func TestMultilineMatchBeforeNegate(t *testing.T) {
+	// Lines not ending in a semicolon continue onto the next line
+	m := makeMultiline(t, MultilineConfig{Pattern: `;$`, Negate: true, Match: "before"})
+
+	shipped := feedMultiline(m, []string{"a", "b", "c;", "d;"})
+
+	if len(shipped) != 2 {
+		t.Fatalf("Expected 2 events to be shipped, got %d", len(shipped))
+	}
+	if shipped[0].text != "a\nb\nc;" || shipped[0].offset != 0 || shipped[0].length != 7 {
+		t.Fatalf("Unexpected first event %v", *shipped[0])
+	}
+	if shipped[1].text != "d;" || shipped[1].offset != 7 || shipped[1].length != 3 {
+		t.Fatalf("Unexpected second event %v", *shipped[1])
+	}
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	m := makeMultiline(t, MultilineConfig{Pattern: `^\s`, MaxLines: 2})
+
+	feedMultiline(m, []string{"first", " 2", " 3", " 4"})
+
+	last := m.flush()
+	if last.text != "first\n 2" {
+		t.Fatalf("Expected lines past max lines to be dropped, got %q", last.text)
+	}
+	if last.length != 15 {
+		t.Fatalf("Expected dropped lines to still count towards the length, got %d", last.length)
+	}
+	if !last.truncated {
+		t.Fatalf("Expected an event with dropped lines to be marked truncated")
+	}
+}
+
+func TestMultilineConfigErrors(t *testing.T) {
+	bad := []MultilineConfig{
+		{},
+		{Pattern: `(`},
+		{Pattern: `^\s`, Match: "sideways"},
+		{Pattern: `^\s`, Timeout: "soon"},
+	}
+	for _, config := range bad {
+		if err := loadMultilineConfig(&config); err == nil {
+			t.Errorf("Expected an error loading multiline config %v", config)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A window of events, sent as one compressed frame and acknowledged by
+// sequence number.
+type window struct {
+	events    []*FileEvent
+	positions []int  // where each event that is sent sits in events
+	first     uint32 // sequence number of the first event sent
+	acked     int    // how many of the events sent have been acknowledged
+	released  int    // how many of events have been passed to the registrar
+}
+
+// Some events only carry state for the registrar, so are not sent, but stay
+// in the window so the registrar learns about them in order.
+func newWindow(events []*FileEvent) *window {
+	w := &window{events: events, positions: make([]int, 0, len(events))}
+	for i, event := range events {
+		if !event.isMarker() {
+			w.positions = append(w.positions, i)
+		}
+	}
+	return w
+}
+
+// The number of events sent in the window.
+func (w *window) count() int {
+	return len(w.positions)
+}
+
+func (w *window) last() uint32 {
+	return w.first + uint32(w.count()) - 1
+}
+
+func (w *window) complete() bool {
+	return w.acked == w.count()
+}
+
+// Encode the window as frames of the given protocol version, numbering the
+// events sent after sequence.
+func (w *window) encode(protocol int, sequence *uint32) ([]byte, error) {
+	var payload bytes.Buffer
+	compressor, _ := zlib.NewWriterLevel(&payload, 3)
+	counter := &countingWriter{writer: compressor}
+	w.first = *sequence + 1
+	for _, i := range w.positions {
+		*sequence += 1
+		if protocol == 1 {
+			writeDataFrame(w.events[i], *sequence, counter)
+		} else if err := writeJSONFrame(w.events[i], *sequence, counter); err != nil {
+			return nil, err
+		}
+	}
+	compressor.Close()
+	reportPayload(w.count(), counter.count, payload.Len())
+
+	// Set the window size to the number of events, then the compressed frame
+	version := byte('0' + protocol)
+	var frame bytes.Buffer
+	frame.Write([]byte{version, 'W'})
+	binary.Write(&frame, binary.BigEndian, uint32(w.count()))
+	frame.Write([]byte{version, 'C'})
+	binary.Write(&frame, binary.BigEndian, uint32(payload.Len()))
+	frame.Write(payload.Bytes())
+	return frame.Bytes(), nil
+}
+
+// Counts the bytes written through it, to report the size of a payload
+// before it is compressed.
+type countingWriter struct {
+	writer io.Writer
+	count  int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count += n
+	return n, err
+}
+
+// Record an ack, which covers every event sent up to and including the one
+// with the given sequence number. Returns false if the sequence number is not
+// in the window.
+func (w *window) ack(sequence uint32) bool {
+	offset := sequence - w.first
+	if offset >= uint32(w.count()) {
+		return false
+	}
+	if int(offset)+1 > w.acked {
+		w.acked = int(offset) + 1
+	}
+	return true
+}
+
+// Return the events newly acknowledged, to pass on to the registrar. Events
+// that are not sent are held back with the sent event after them, as they
+// may record an offset past it.
+func (w *window) release() []*FileEvent {
+	end := 0
+	if w.complete() {
+		end = len(w.events)
+	} else if w.acked != 0 {
+		end = w.positions[w.acked-1] + 1
+	}
+	released := w.events[w.released:end]
+	w.released = end
+	return released
+}
+
+// Return a new window of the events not yet released, to send again.
+func (w *window) remaining() *window {
+	return newWindow(w.events[w.released:])
+}
+
+// Read an ack frame, the protocol version and 'A' followed by the sequence
+// number acknowledged.
+func readAck(socket io.Reader, protocol int) (uint32, error) {
+	var response [6]byte
+	if _, err := io.ReadFull(socket, response[:]); err != nil {
+		return 0, err
+	}
+	if response[0] != byte('0'+protocol) || response[1] != 'A' {
+		return 0, fmt.Errorf("expected an ack frame, got %q", response[:2])
+	}
+	return binary.BigEndian.Uint32(response[2:]), nil
+}
+
+// PublishPipelined keeps up to config.WindowsInFlight windows in flight on
+// one connection rather than waiting for each window to be acknowledged
+// before sending the next, so throughput is not bound by the round trip
+// time. Acks are matched to windows by sequence number, and the registrar is
+// told about events strictly in the order they were spooled.
+func PublishPipelined(input chan []*FileEvent,
+	registrar chan []*FileEvent,
+	config *NetworkConfig) [][]*FileEvent {
+	var sequence uint32
+	var pending []*window
+
+	socket := connect(config)
+	for {
+		if socket == nil {
+			var batches [][]*FileEvent
+			for _, w := range pending {
+				batches = append(batches, w.events)
+			}
+			return unpublished(input, batches...)
+		}
+		var err error
+		pending, err = pipeline(socket, input, registrar, pending, &sequence, config)
+		socket.Close()
+
+		switch err := err.(type) {
+		case nil:
+			return nil
+		case *failbackError:
+			socket = err.socket
+		default:
+			emit("Socket error, will reconnect: %s\n", err)
+			time.Sleep(1 * time.Second)
+			socket = connect(config)
+		}
+	}
+} // PublishPipelined
+
+// Returned by pipeline when nothing is in flight and it connected to a
+// server of higher priority than the one it was sending to, to carry on with.
+type failbackError struct {
+	socket net.Conn
+}
+
+func (e *failbackError) Error() string {
+	return "failing back to a server of higher priority"
+}
+
+// Send windows on socket, starting with any left over from an earlier
+// connection, until the connection fails or input is closed and every window
+// has been acknowledged. On failure, returns the windows still to be sent.
+func pipeline(socket net.Conn,
+	input chan []*FileEvent,
+	registrar chan []*FileEvent,
+	retry []*window,
+	sequence *uint32,
+	config *NetworkConfig) ([]*window, error) {
+	acks := make(chan uint32, config.WindowsInFlight)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			ack, err := readAck(socket, config.Protocol)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case acks <- ack:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var pending []*window
+
+	// Waiting for an ack from the server, rather than for more events
+	waiting := func() bool {
+		for _, w := range pending {
+			if !w.complete() {
+				return true
+			}
+		}
+		return false
+	}
+
+	send := func(w *window) error {
+		if w.count() != 0 {
+			frame, err := w.encode(config.Protocol, sequence)
+			if err != nil {
+				return err
+			}
+			// Abort if the server takes longer than the configured network
+			// timeout to acknowledge anything
+			if !waiting() {
+				socket.SetReadDeadline(time.Now().Add(config.timeout))
+			}
+			socket.SetWriteDeadline(time.Now().Add(config.timeout))
+			if _, err = socket.Write(frame); err != nil {
+				return err
+			}
+		}
+		pending = append(pending, w)
+		return nil
+	}
+
+	unsent := func() []*window {
+		remaining := make([]*window, len(pending))
+		for i, w := range pending {
+			remaining[i] = w.remaining()
+		}
+		return remaining
+	}
+
+	for i, w := range retry {
+		if err := send(w); err != nil {
+			return append(unsent(), retry[i:]...), err
+		}
+	}
+
+	for {
+		// Pass acknowledged events to the registrar in order, dropping
+		// windows once they are complete
+		for len(pending) != 0 {
+			if released := pending[0].release(); len(released) != 0 {
+				registrar <- released
+			}
+			if !pending[0].complete() {
+				break
+			}
+			pending = pending[1:]
+		}
+
+		if input == nil && len(pending) == 0 {
+			return nil, nil
+		}
+		if len(pending) == 0 {
+			if better := dialHigherPriority(config); better != nil {
+				return nil, &failbackError{socket: better}
+			}
+		}
+
+		// Only take more events when there is room for another window
+		var next chan []*FileEvent
+		if len(pending) < config.WindowsInFlight {
+			next = input
+		}
+
+		select {
+		case events, ok := <-next:
+			if !ok {
+				input = nil
+				continue
+			}
+			if err := send(newWindow(events)); err != nil {
+				return unsent(), err
+			}
+		case ack := <-acks:
+			if int32(ack-*sequence) > 0 {
+				return unsent(), fmt.Errorf("ack for sequence %d, which was not sent yet", ack)
+			}
+			for _, w := range pending {
+				if w.complete() {
+					continue
+				}
+				// An ack before the window is nothing new: a repeated ack,
+				// or a keepalive
+				if w.ack(ack) || int32(ack-w.last()) < 0 {
+					break
+				}
+				// The ack is for a later window, so covers all of this one
+				w.acked = w.count()
+			}
+			if waiting() {
+				socket.SetReadDeadline(time.Now().Add(config.timeout))
+			} else {
+				socket.SetReadDeadline(time.Time{})
+			}
+		case err := <-failed:
+			return unsent(), err
+		}
+	}
+}
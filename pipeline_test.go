@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	config := &NetworkConfig{Protocol: 2, WindowsInFlight: 2, timeout: 5 * time.Second}
+
+	go func() {
+		// Both windows arrive before either is acknowledged
+		first, _ := readWindowv2(server)
+		second, err := readWindowv2(server)
+		if err != nil {
+			t.Errorf("Error reading second window: %s", err)
+			return
+		}
+		writeAckv2(server, first[0].sequence)
+		writeAckv2(server, second[len(second)-1].sequence)
+
+		third, _ := readWindowv2(server)
+		writeAckv2(server, third[0].sequence)
+	}()
+
+	batches := [][]*FileEvent{makeEvents("one", "two"), makeEvents("three", ""), makeEvents("four")}
+	input := make(chan []*FileEvent, len(batches))
+	for _, batch := range batches {
+		input <- batch
+	}
+	close(input)
+	registrar := make(chan []*FileEvent, 10)
+
+	var sequence uint32
+	remaining, err := pipeline(client, input, registrar, nil, &sequence, config)
+	if err != nil || remaining != nil {
+		t.Fatalf("Expected every window to be acknowledged, got %v with %d remaining", err, len(remaining))
+	}
+	close(registrar)
+
+	// The registrar gets the events in order, the first batch in two parts
+	expected := [][]*FileEvent{batches[0][:1], batches[0][1:], batches[1], batches[2]}
+	i := 0
+	for events := range registrar {
+		if i == len(expected) || len(events) != len(expected[i]) || events[0] != expected[i][0] {
+			t.Fatalf("Unexpected events passed to the registrar at %d: %v", i, events)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("Expected %d updates to the registrar, got %d", len(expected), i)
+	}
+}
+
+func TestPipelineFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	config := &NetworkConfig{Protocol: 2, WindowsInFlight: 2, timeout: 5 * time.Second}
+
+	go func() {
+		first, _ := readWindowv2(server)
+		readWindowv2(server)
+		writeAckv2(server, first[0].sequence)
+		// Let the ack be read before going away
+		time.Sleep(100 * time.Millisecond)
+		server.Close()
+	}()
+
+	batches := [][]*FileEvent{makeEvents("one", "", "two"), makeEvents("three")}
+	input := make(chan []*FileEvent, len(batches))
+	for _, batch := range batches {
+		input <- batch
+	}
+	registrar := make(chan []*FileEvent, 10)
+
+	var sequence uint32
+	remaining, err := pipeline(client, input, registrar, nil, &sequence, config)
+	if err == nil {
+		t.Fatalf("Expected an error when the connection closed")
+	}
+	if len(registrar) != 1 || len(<-registrar) != 1 {
+		t.Fatalf("Expected only the first event to be passed to the registrar")
+	}
+
+	// What was not acknowledged is sent again, in order
+	if len(remaining) != 2 {
+		t.Fatalf("Expected 2 windows to send again, got %d", len(remaining))
+	}
+	if len(remaining[0].events) != 2 || remaining[0].count() != 1 || remaining[0].events[1] != batches[0][2] {
+		t.Errorf("Expected the dropped event and \"two\" to be sent again, got %v", remaining[0].events)
+	}
+	if remaining[1].events[0] != batches[1][0] {
+		t.Errorf("Expected the second window to be sent again, got %v", remaining[1].events)
+	}
+}
+
+func TestPublishPipelinedTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	chkerr(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			frames, err := readWindowv2(conn)
+			if err != nil {
+				return
+			}
+			writeAckv2(conn, frames[len(frames)-1].sequence)
+		}
+	}()
+
+	config := &NetworkConfig{
+		Servers:         []string{listener.Addr().String()},
+		Transport:       "tcp",
+		Protocol:        2,
+		WindowsInFlight: 2,
+		timeout:         5 * time.Second,
+	}
+	input := make(chan []*FileEvent, 3)
+	for i := 0; i < cap(input); i++ {
+		input <- makeEvents("one", "two")
+	}
+	close(input)
+	registrar := make(chan []*FileEvent, cap(input))
+
+	done := make(chan struct{})
+	go func() {
+		PublishPipelined(input, registrar, config)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out publishing over plain TCP")
+	}
+	if len(registrar) != cap(input) {
+		t.Fatalf("Expected %d batches to be acknowledged, got %d", cap(input), len(registrar))
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,28 +24,57 @@ type Prospector struct {
 	prospectorinfo map[string]ProspectorInfo
 	iteration      uint32
 	lastscan       time.Time
+	paths          []string /* the paths to scan, leaving out stdin */
+
+	stop       chan struct{}                /* closed to stop prospecting and harvesting */
+	done       chan struct{}                /* closed once every harvester has stopped */
+	harvesters sync.WaitGroup               /* the harvesters running, except on stdin */
+	launched   map[string]*Harvester        /* the last harvester started on each file known */
+	finish     map[chan int64]chan struct{} /* to have the running harvester sending on a channel stop at the end of its file */
+}
+
+func newProspector(fileconfig FileConfig) *Prospector {
+	// The config may be shared with the caller, so keep our own paths
+	fileconfig.Paths = append([]string(nil), fileconfig.Paths...)
+	return &Prospector{
+		FileConfig: fileconfig,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		launched:   make(map[string]*Harvester),
+		finish:     make(map[chan int64]chan struct{}),
+	}
+}
+
+// Stop looking for files and harvesting them, and wait for the harvesters to
+// stop. Reading stdin can't be interrupted, so its harvester is left be.
+func (p *Prospector) Stop() {
+	close(p.stop)
+	<-p.done
 }
 
 func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent) {
+	defer close(p.done)
+	defer p.harvesters.Wait()
+
 	p.prospectorinfo = make(map[string]ProspectorInfo)
 
-	// Handle any "-" (stdin) paths
-	for i, path := range p.FileConfig.Paths {
+	// Handle any "-" (stdin) paths, and scan the others
+	p.paths = nil
+	for _, path := range p.FileConfig.Paths {
 		if path == "-" {
 			// Offset and Initial never get used when path is "-"
-			harvester := Harvester{Path: path, FileConfig: p.FileConfig}
+			harvester := Harvester{Path: path, FileConfig: p.FileConfig, FinishChan: make(chan int64, 1), stop: p.stop}
 			go harvester.Harvest(output)
-
-			// Remove it from the file list
-			p.FileConfig.Paths = append(p.FileConfig.Paths[:i], p.FileConfig.Paths[i+1:]...)
+			continue
 		}
+		p.paths = append(p.paths, path)
 	}
 
 	// Seed last scan time
 	p.lastscan = time.Now()
 
 	// Now let's do one quick scan to pick up new files
-	for _, path := range p.FileConfig.Paths {
+	for _, path := range p.paths {
 		p.scan(path, output, resume)
 	}
 
@@ -53,10 +84,24 @@ func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent)
 	}
 	resume.persist <- event
 
+	var watcher *dirWatcher
+	if p.FileConfig.Discovery == "inotify" {
+		var err error
+		if watcher, err = newDirWatcher(); err != nil {
+			emit("Failed to start inotify, falling back to polling: %s\n", err)
+		} else {
+			defer watcher.close()
+		}
+	}
+
 	for {
 		newlastscan := time.Now()
 
-		for _, path := range p.FileConfig.Paths {
+		for _, path := range p.paths {
+			if watcher != nil {
+				p.watch(watcher, path)
+			}
+
 			// Scan - flag false so new files always start at beginning
 			p.scan(path, output, nil)
 		}
@@ -64,12 +109,32 @@ func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent)
 		p.lastscan = newlastscan
 
 		// Defer next scan for a bit.
-		time.Sleep(10 * time.Second) // Make this tunable
+		var changed chan bool
+		next_scan := p.FileConfig.scanFrequency
+		if watcher != nil {
+			// Rescan as soon as files come or go, and still every scan
+			// frequency in case we missed something, such as a new directory
+			// matching the glob, events on NFS or an overflowed queue
+			changed = watcher.changed
+		}
+		select {
+		case <-changed:
+		case <-time.After(next_scan):
+		case <-p.stop:
+			emit("Stopping prospector for %v\n", p.paths)
+			return
+		}
 
 		// Clear out files that disappeared and we've stopped harvesting
 		for file, lastinfo := range p.prospectorinfo {
 			if len(lastinfo.harvester) != 0 && lastinfo.last_seen < p.iteration {
 				delete(p.prospectorinfo, file)
+				delete(p.launched, file)
+			}
+		}
+		for harvester := range p.finish {
+			if len(harvester) != 0 {
+				delete(p.finish, harvester)
 			}
 		}
 
@@ -77,10 +142,98 @@ func (p *Prospector) Prospect(resume *ProspectorResume, output chan *FileEvent)
 	}
 } /* Prospect */
 
+// Return where the harvesters of a stopped prospector got to in each file,
+// after the last event they shipped.
+func (p *Prospector) finalStates() map[string]*FileState {
+	states := make(map[string]*FileState)
+	for _, harvester := range p.launched {
+		event := harvester.last
+		if event == nil {
+			continue
+		}
+		state := &FileState{Source: event.Source, Offset: event.Offset + event.RawBytes, Finished: event.Finished}
+		state.Inode, state.Device = file_ids(event.fileinfo)
+		states[*event.Source] = state
+	}
+	return states
+}
+
+// Start harvesting a file, until the prospector is stopped.
+func (p *Prospector) harvest(harvester *Harvester, output chan *FileEvent) {
+	harvester.stop = p.stop
+	harvester.finish = make(chan struct{})
+	p.launched[harvester.Path] = harvester
+	p.finish[harvester.FinishChan] = harvester.finish
+	p.harvesters.Add(1)
+	go func() {
+		defer p.harvesters.Done()
+		harvester.Harvest(output)
+	}()
+}
+
+// Watch the directories that files matching path could appear in.
+func (p *Prospector) watch(watcher *dirWatcher, path string) {
+	dirs, err := expandGlob(filepath.Dir(path), p.FileConfig.MaxGlobDepth)
+	if err != nil {
+		emit("glob(%s) failed: %v\n", filepath.Dir(path), err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := watcher.watch(dir); err != nil {
+			emit("Failed to watch directory %s: %s\n", dir, err)
+		}
+	}
+}
+
+// Like filepath.Glob, but a "**" path component matches any number of
+// directories, up to maxDepth deep.
+func expandGlob(pattern string, maxDepth int) ([]string, error) {
+	components := strings.Split(pattern, string(filepath.Separator))
+
+	recursive := -1
+	for i, component := range components {
+		if component == "**" {
+			recursive = i
+			break
+		}
+	}
+	if recursive == -1 {
+		return filepath.Glob(pattern)
+	}
+
+	// Try the pattern with "**" replaced by 0 to maxDepth "*" components,
+	// expanding any further "**" in the rest of it the same way
+	var matches []string
+	seen := make(map[string]bool)
+	for depth := 0; depth <= maxDepth; depth++ {
+		expanded := append([]string{}, components[:recursive]...)
+		for i := 0; i < depth; i++ {
+			expanded = append(expanded, "*")
+		}
+		expanded = append(expanded, components[recursive+1:]...)
+
+		depthMatches, err := expandGlob(strings.Join(expanded, string(filepath.Separator)), maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range depthMatches {
+			if !seen[match] {
+				seen[match] = true
+				matches = append(matches, match)
+			}
+		}
+	}
+	return matches, nil
+}
+
 func (p *Prospector) scan(path string, output chan *FileEvent, resume *ProspectorResume) {
 
 	// Evaluate the path as a wildcards/shell glob
-	matches, err := filepath.Glob(path)
+	matches, err := expandGlob(path, p.FileConfig.MaxGlobDepth)
 	if err != nil {
 		emit("glob(%s) failed: %v\n", path, err)
 		return
@@ -91,6 +244,10 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 
 	// Check any matched files to see if we need to start a harvester
 	for _, file := range matches {
+		if p.isExcluded(file) {
+			continue
+		}
+
 		// Stat the file, following any symlinks.
 		fileinfo, err := os.Stat(file)
 		// TODO(sissel): check err
@@ -115,15 +272,54 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 			// Create a new prospector info with the stat info for comparison
 			newinfo = ProspectorInfo{fileinfo: fileinfo, harvester: make(chan int64, 1), last_seen: p.iteration}
 
-			// Check for dead time, but only if the file modification time is before the last scan started
-			// This ensures we don't skip genuine creations with dead times less than 10s
-			if fileinfo.ModTime().Before(p.lastscan) && time.Since(fileinfo.ModTime()) > p.FileConfig.deadtime {
+			// Compressed files are read once from start to end, however old they are
+			if p.FileConfig.isCompressed(file) {
+				var offset int64 = 0
+				var is_finished bool = false
+
+				if resume != nil {
+					offset, _, is_finished = p.calculate_resume(file, fileinfo, resume)
+				}
+
+				// A file compressed after it was rotated holds what the
+				// harvester of the rotated file read, so carry on from where
+				// that harvester got to once it is done
+				rotated := strings.TrimSuffix(file, ".gz")
+				if previous, ok := p.prospectorinfo[rotated]; ok && !is_finished {
+					if len(previous.harvester) == 0 {
+						// Have the harvester stop at the end of the rotated file
+						// rather than after dead time. This file is not recorded,
+						// so is considered again on the next scan
+						if finish, ok := p.finish[previous.harvester]; ok {
+							emit("Waiting for the harvester of %s to finish before reading %s\n", rotated, file)
+							close(finish)
+							delete(p.finish, previous.harvester)
+						}
+						continue
+					}
+					offset = <-previous.harvester
+					previous.harvester <- offset
+				}
+
+				if is_finished {
+					// Push the offset so we continue from there if this file is ever modified
+					emit("Skipping compressed file that was already harvested: %s\n", file)
+					newinfo.harvester <- offset
+				} else {
+					emit("Launching harvester on compressed file: %s\n", file)
+					harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: offset, FinishChan: newinfo.harvester}
+					p.harvest(harvester, output)
+				}
+
+				// Check for dead time, but only if the file modification time is before the last scan started
+				// This ensures we don't skip genuine creations with dead times less than the scan frequency
+			} else if fileinfo.ModTime().Before(p.lastscan) && time.Since(fileinfo.ModTime()) > p.FileConfig.deadtime {
 				var offset int64 = 0
 				var is_resuming bool = false
 
 				if resume != nil {
 					// Call the calculator - it will process resume state if there is one
-					offset, is_resuming = p.calculate_resume(file, fileinfo, resume)
+					offset, is_resuming, _ = p.calculate_resume(file, fileinfo, resume)
 				}
 
 				// Are we resuming a dead file? We have to resume even if dead so we catch any old updates to the file
@@ -132,7 +328,7 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 				if is_resuming {
 					emit("Resuming harvester on a previously harvested file: %s\n", file)
 					harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: offset, FinishChan: newinfo.harvester}
-					go harvester.Harvest(output)
+					p.harvest(harvester, output)
 				} else {
 					// Old file, skip it, but push offset of file size so we start from the end if this file changes and needs picking up
 					emit("Skipping file (older than dead time of %v): %s\n", p.FileConfig.deadtime, file)
@@ -149,7 +345,7 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 
 				if resume != nil {
 					// Call the calculator - it will process resume state if there is one
-					offset, is_resuming = p.calculate_resume(file, fileinfo, resume)
+					offset, is_resuming, _ = p.calculate_resume(file, fileinfo, resume)
 				}
 
 				// Are we resuming a file or is this a completely new file?
@@ -161,7 +357,7 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 
 				// Launch the harvester
 				harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: offset, FinishChan: newinfo.harvester}
-				go harvester.Harvest(output)
+				p.harvest(harvester, output)
 			}
 		} else {
 			// Update the fileinfo information used for future comparisons, and the last_seen counter
@@ -184,7 +380,7 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 
 					// Start a harvester on the path
 					harvester := &Harvester{Path: file, FileConfig: p.FileConfig, FinishChan: newinfo.harvester}
-					go harvester.Harvest(output)
+					p.harvest(harvester, output)
 				}
 
 				// Keep the old file in missinginfo so we don't rescan it if it was renamed and we've not yet reached the new filename
@@ -197,7 +393,7 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 				// Start a harvester on the path; an old file was just modified and it doesn't have a harvester
 				// The offset to continue from will be stored in the harvester channel - so take that to use and also clear the channel
 				harvester := &Harvester{Path: file, FileConfig: p.FileConfig, Offset: <-newinfo.harvester, FinishChan: newinfo.harvester}
-				go harvester.Harvest(output)
+				p.harvest(harvester, output)
 			}
 		}
 
@@ -207,14 +403,24 @@ func (p *Prospector) scan(path string, output chan *FileEvent, resume *Prospecto
 	} // for each file matched by the glob
 }
 
-func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume *ProspectorResume) (int64, bool) {
+// Return true if the file matches any of the "exclude files" patterns.
+func (p *Prospector) isExcluded(file string) bool {
+	for _, exclude := range p.FileConfig.excludeFiles {
+		if exclude.match(file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume *ProspectorResume) (int64, bool, bool) {
 	last_state, is_found := resume.files[file]
 
 	if is_found && is_file_same(file, fileinfo, last_state) {
 		// We're resuming - throw the last state back downstream so we resave it
 		// And return the offset - also force harvest in case the file is old and we're about to skip it
 		resume.persist <- last_state
-		return last_state.Offset, true
+		return last_state.Offset, true, last_state.Finished
 	}
 
 	if previous := is_file_renamed_resumelist(file, fileinfo, resume.files); previous != "" {
@@ -225,7 +431,7 @@ func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume
 		last_state := resume.files[previous]
 		last_state.Source = &file
 		resume.persist <- last_state
-		return last_state.Offset, true
+		return last_state.Offset, true, last_state.Finished
 	}
 
 	if is_found {
@@ -233,5 +439,5 @@ func (p *Prospector) calculate_resume(file string, fileinfo os.FileInfo, resume
 	}
 
 	// New file so just start from an automatic position
-	return 0, false
+	return 0, false, false
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExpandGlobRecursive(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	files := []string{
+		"app.log",
+		"2015-01-01/app.log",
+		"2015-01-01/tenant/app.log",
+		"2015-01-01/tenant/deeper/app.log",
+		"2015-01-01/tenant/other.txt",
+	}
+	for _, file := range files {
+		file = filepath.Join(tmpdir, file)
+		chkerr(t, os.MkdirAll(filepath.Dir(file), 0755))
+		chkerr(t, ioutil.WriteFile(file, []byte{}, 0644))
+	}
+
+	tests := []struct {
+		pattern  string
+		maxDepth int
+		expected []string
+	}{
+		{"**/*.log", 8, []string{"2015-01-01/app.log", "2015-01-01/tenant/app.log", "2015-01-01/tenant/deeper/app.log", "app.log"}},
+		{"**/*.log", 1, []string{"2015-01-01/app.log", "app.log"}},
+		{"*/**/app.log", 8, []string{"2015-01-01/app.log", "2015-01-01/tenant/app.log", "2015-01-01/tenant/deeper/app.log"}},
+		{"**/tenant/**/*.txt", 8, []string{"2015-01-01/tenant/other.txt"}},
+		{"*.log", 8, []string{"app.log"}},
+	}
+
+	for _, test := range tests {
+		matches, err := expandGlob(filepath.Join(tmpdir, test.pattern), test.maxDepth)
+		chkerr(t, err)
+
+		for i := range matches {
+			matches[i], _ = filepath.Rel(tmpdir, matches[i])
+		}
+		sort.Strings(matches)
+
+		if !reflect.DeepEqual(matches, test.expected) {
+			t.Errorf("Expected %s (max depth %d) to match %v, got %v", test.pattern, test.maxDepth, test.expected, matches)
+		}
+	}
+}
+
+func TestProspectorStop(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	chkerr(t, ioutil.WriteFile(filepath.Join(tmpdir, "app.log"), []byte("one\ntwo\n"), 0644))
+	fileconfig := FileConfig{Paths: []string{filepath.Join(tmpdir, "*.log")}}
+	chkerr(t, loadFileConfig(&fileconfig))
+
+	// Nothing reads the second event, so the harvester is stuck sending it
+	output := make(chan *FileEvent)
+	resume := &ProspectorResume{files: map[string]*FileState{}, persist: make(chan *FileState, 1)}
+	p := newProspector(fileconfig)
+	go p.Prospect(resume, output)
+	if event := <-output; *event.Text != "one" {
+		t.Fatalf("Expected the first line to be harvested, got %q", *event.Text)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the prospector and its harvester to stop")
+	}
+}
+
+func TestProspectorRotatedThenCompressed(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	fileconfig := FileConfig{Paths: []string{filepath.Join(tmpdir, "app.log*")}, Gzip: true, IdleTimeout: "100ms"}
+	chkerr(t, loadFileConfig(&fileconfig))
+	p := newProspector(fileconfig)
+	p.prospectorinfo = make(map[string]ProspectorInfo)
+	output := make(chan *FileEvent, 10)
+
+	// A rotated file is still being harvested when it is compressed
+	rotated := filepath.Join(tmpdir, "app.log.1")
+	chkerr(t, ioutil.WriteFile(rotated, []byte("one\ntwo\n"), 0644))
+	p.scan(fileconfig.Paths[0], output, nil)
+	for _, text := range []string{"one", "two"} {
+		if event := <-output; *event.Text != text {
+			t.Fatalf("Expected %q from the rotated file, got %q", text, *event.Text)
+		}
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("one\ntwo\nthree\n"))
+	gz.Close()
+	chkerr(t, ioutil.WriteFile(rotated+".gz", compressed.Bytes(), 0644))
+	chkerr(t, os.Remove(rotated))
+
+	p.scan(fileconfig.Paths[0], output, nil)
+	if _, ok := p.prospectorinfo[rotated+".gz"]; ok {
+		t.Fatalf("Expected the compressed file to wait for the harvester of the rotated file")
+	}
+	if len(p.finish) != 0 {
+		t.Fatalf("Expected the harvester of the rotated file to be asked to finish")
+	}
+
+	// That harvester stops at the end of the file rather than after dead
+	// time, and only what it did not ship is read
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.prospectorinfo[rotated].harvester) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the harvester of the rotated file to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.scan(fileconfig.Paths[0], output, nil)
+	p.harvesters.Wait()
+	close(output)
+	var events []*FileEvent
+	for event := range output {
+		events = append(events, event)
+	}
+	if len(events) != 2 || *events[0].Text != "three" || events[0].Offset != 8 || !events[1].Finished {
+		t.Errorf("Expected the compressed file to be read from offset 8, got %v", events)
+	}
+}
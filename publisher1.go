@@ -4,17 +4,16 @@ import (
 	"bytes"
 	"compress/zlib"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/binary"
-	"encoding/pem"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
 	"regexp"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -32,27 +31,52 @@ func init() {
 
 func Publishv1(input chan []*FileEvent,
 	registrar chan []*FileEvent,
-	config *NetworkConfig) {
+	config *NetworkConfig) [][]*FileEvent {
 	var buffer bytes.Buffer
-	var socket *tls.Conn
+	var socket net.Conn
 	var sequence uint32
 	var err error
 
 	socket = connect(config)
-	defer socket.Close()
+	defer func() {
+		if socket != nil {
+			socket.Close()
+		}
+	}()
 
 	for events := range input {
+		if socket != nil {
+			socket = failback(socket, config)
+		}
+		if socket == nil {
+			return unpublished(input, events)
+		}
+
+		// Some events only carry state for the registrar, so are not sent
+		shipping := make([]*FileEvent, 0, len(events))
+		for _, event := range events {
+			if !event.isMarker() {
+				shipping = append(shipping, event)
+			}
+		}
+		if len(shipping) == 0 {
+			registrar <- events
+			continue
+		}
+
 		buffer.Truncate(0)
 		compressor, _ := zlib.NewWriterLevel(&buffer, 3)
+		counter := &countingWriter{writer: compressor}
 
-		for _, event := range events {
+		for _, event := range shipping {
 			sequence += 1
-			writeDataFrame(event, sequence, compressor)
+			writeDataFrame(event, sequence, counter)
 		}
 		compressor.Flush()
 		compressor.Close()
 
 		compressed_payload := buffer.Bytes()
+		reportPayload(len(shipping), counter.count, len(compressed_payload))
 
 		// Send buffer until we're successful...
 		oops := func(err error) {
@@ -69,6 +93,10 @@ func Publishv1(input chan []*FileEvent,
 
 	SendPayload:
 		for {
+			if socket == nil {
+				return unpublished(input, events)
+			}
+
 			// Abort if our whole request takes longer than the configured
 			// network timeout.
 			socket.SetDeadline(time.Now().Add(config.timeout))
@@ -79,7 +107,7 @@ func Publishv1(input chan []*FileEvent,
 				oops(err)
 				continue
 			}
-			binary.Write(socket, binary.BigEndian, uint32(len(events)))
+			binary.Write(socket, binary.BigEndian, uint32(len(shipping)))
 			if err != nil {
 				oops(err)
 				continue
@@ -125,118 +153,251 @@ func Publishv1(input chan []*FileEvent,
 		// Tell the registrar that we've successfully sent these events
 		registrar <- events
 	} /* for each event payload */
+	return nil
 } // Publish
 
-func connect(config *NetworkConfig) (socket *tls.Conn) {
-	var tlsconfig tls.Config
-	tlsconfig.MinVersion = tls.VersionTLS10
+// Connect to the best server available. This is called when starting, and
+// when the last connection failed, so that server is backed off from first.
+// Returns nil if the publisher is replaced before it connects.
+func connect(config *NetworkConfig) (socket net.Conn) {
+	material := tlsMaterialFor(config)
 
-	if len(config.SSLCertificate) > 0 && len(config.SSLKey) > 0 {
-		emit("Loading client ssl certificate: %s and %s\n",
-			config.SSLCertificate, config.SSLKey)
-		cert, err := tls.LoadX509KeyPair(config.SSLCertificate, config.SSLKey)
-		if err != nil {
-			fault ("Failed loading client ssl certificate: %s\n", err)
-		}
-		tlsconfig.Certificates = []tls.Certificate{cert}
+	if config.servers == nil {
+		config.servers = newServerPool(config)
+	}
+	pool := config.servers
+	if pool.current != nil {
+		delay := pool.current.failed(pool.backoff)
+		emit("Backing off from %s for %v\n", pool.current.hostport, delay)
+		pool.current = nil
 	}
 
-	if len(config.SSLCA) > 0 {
-		emit("Setting trusted CA from file: %s\n", config.SSLCA)
-		tlsconfig.RootCAs = x509.NewCertPool()
+	for !replaced(config) {
+		// Pick a random server from the best group available.
+		server, wait := pool.pick()
+		if server == nil {
+			emit("Every server is backing off, waiting %v\n", wait)
+			backoffWait(config, wait)
+			continue
+		}
 
-		pemdata, err := ioutil.ReadFile(config.SSLCA)
+		var err error
+		socket, err = dial(server.hostport, material, config)
 		if err != nil {
-			fault("Failure reading CA certificate: %s\n", err)
+			delay := server.failed(pool.backoff)
+			emit("Backing off from %s for %v\n", server.hostport, delay)
+			continue
 		}
 
-		block, _ := pem.Decode(pemdata)
-		if block == nil {
-			fault("Failed to decode PEM data, is %s a valid cert?\n", config.SSLCA)
-		}
-		if block.Type != "CERTIFICATE" {
-			fault("This is not a certificate file: %s\n", config.SSLCA)
-		}
+		// connected, let's rock and roll.
+		server.connected = time.Now()
+		pool.current = server
+		return
+	}
+	emit("Giving up connecting, as the network config changed\n")
+	return nil
+}
 
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			fault("Failed to parse a certificate: %s\n", config.SSLCA)
-		}
-		tlsconfig.RootCAs.AddCert(cert)
+// Return true once a publisher for a new network config takes over from the
+// one for config.
+func replaced(config *NetworkConfig) bool {
+	select {
+	case <-config.stop:
+		return true
+	default:
+		return false
 	}
+}
 
-	for {
-		// Pick a random server from the list.
-		hostport := config.Servers[rand.Int()%len(config.Servers)]
-		submatch := hostport_re.FindSubmatch([]byte(hostport))
-		if submatch == nil {
-			fault("Invalid host:port given: %s", hostport)
-		}
-		host := string(submatch[1])
-		port := string(submatch[2])
-		addresses, err := net.LookupHost(host)
+// Wait for d, or until the publisher for config is replaced. Returns false if
+// it was replaced.
+func backoffWait(config *NetworkConfig, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-config.stop:
+		return false
+	}
+}
 
+// Return the batches a replaced publisher did not publish, oldest first:
+// those given, then those left on input, which is closed by then.
+func unpublished(input chan []*FileEvent, batches ...[]*FileEvent) [][]*FileEvent {
+	for events := range input {
+		batches = append(batches, events)
+	}
+	return batches
+}
+
+// Move to a server of higher priority than the one connected to, once one
+// may be healthy again. The connection is only closed once the other server
+// is connected to, so it is kept while that server is still down. Only call
+// this while no events are waiting to be acknowledged.
+func failback(socket net.Conn, config *NetworkConfig) net.Conn {
+	if better := dialHigherPriority(config); better != nil {
+		socket.Close()
+		return better
+	}
+	return socket
+}
+
+// Connect to a server of higher priority than the one connected to, if one
+// is ready to be tried again, backing off from those that fail. Returns nil
+// if none connects.
+func dialHigherPriority(config *NetworkConfig) net.Conn {
+	pool := config.servers
+	if pool == nil || !pool.failbackDue() {
+		return nil
+	}
+	material := tlsMaterialFor(config)
+	for _, server := range pool.servers {
+		if server.priority >= pool.current.priority {
+			break
+		}
+		if !server.available() {
+			continue
+		}
+		socket, err := dial(server.hostport, material, config)
 		if err != nil {
-			emit("DNS lookup failure \"%s\": %s\n", host, err)
-			time.Sleep(1 * time.Second)
+			delay := server.failed(pool.backoff)
+			emit("Backing off from %s for %v, staying with %s\n", server.hostport, delay, pool.current.hostport)
 			continue
 		}
+		emit("Leaving %s for %s, a server of higher priority\n", pool.current.hostport, server.hostport)
+		server.connected = time.Now()
+		pool.current = server
+		return socket
+	}
+	return nil
+}
 
-		address := addresses[rand.Int()%len(addresses)]
-		var addressport string
+// Connect to one of the addresses of the server at hostport.
+func dial(hostport string, material *tlsMaterial, config *NetworkConfig) (net.Conn, error) {
+	if strings.HasPrefix(hostport, unixScheme) {
+		return dialUnix(strings.TrimPrefix(hostport, unixScheme), material, config)
+	}
 
-		ip := net.ParseIP(address)
-		if len(ip) == net.IPv4len {
-			addressport = fmt.Sprintf("%s:%s", address, port)
-		} else if len(ip) == net.IPv6len {
-			addressport = fmt.Sprintf("[%s]:%s", address, port)
-		}
+	submatch := hostport_re.FindSubmatch([]byte(hostport))
+	if submatch == nil {
+		fault("Invalid host:port given: %s", hostport)
+	}
+	host := string(submatch[1])
+	port := string(submatch[2])
+	addresses, err := net.LookupHost(host)
 
-		emit("Connecting to %s (%s) \n", addressport, host)
+	if err != nil {
+		emit("DNS lookup failure \"%s\": %s\n", host, err)
+		return nil, err
+	}
 
-		tcpsocket, err := net.DialTimeout("tcp", addressport, config.timeout)
-		if err != nil {
-			emit("Failure connecting to %s: %s\n", address, err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
+	address := addresses[rand.Int()%len(addresses)]
+	var addressport string
 
-		tlsconfig.ServerName = host
+	ip := net.ParseIP(address)
+	if len(ip) == net.IPv4len {
+		addressport = fmt.Sprintf("%s:%s", address, port)
+	} else if len(ip) == net.IPv6len {
+		addressport = fmt.Sprintf("[%s]:%s", address, port)
+	}
 
-		socket = tls.Client(tcpsocket, &tlsconfig)
-		socket.SetDeadline(time.Now().Add(config.timeout))
-		err = socket.Handshake()
-		if err != nil {
+	emit("Connecting to %s (%s) \n", addressport, host)
+
+	tcpsocket, err := net.DialTimeout("tcp", addressport, config.timeout)
+	if err != nil {
+		emit("Failure connecting to %s: %s\n", address, err)
+		return nil, err
+	}
+
+	var socket net.Conn = tcpsocket
+	if config.Transport != "tcp" {
+		if socket, err = handshake(tcpsocket, host, material, config); err != nil {
 			emit("Failed to tls handshake with %s %s\n", address, err)
-			time.Sleep(1 * time.Second)
-			socket.Close()
-			continue
+			return nil, err
 		}
+	}
 
-		emit("Connected to %s\n", address)
+	emit("Connected to %s\n", address)
+	return socket, nil
+}
 
-		// connected, let's rock and roll.
-		return
+// Start TLS on a connection to the server named host, closing the connection
+// if that fails.
+func handshake(conn net.Conn, host string, material *tlsMaterial, config *NetworkConfig) (net.Conn, error) {
+	tlsconfig, err := material.clientConfig(host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	socket := tls.Client(conn, tlsconfig)
+	socket.SetDeadline(time.Now().Add(config.timeout))
+	if err = socket.Handshake(); err == nil {
+		err = checkPins(socket.ConnectionState(), config)
+	}
+	if err != nil {
+		socket.Close()
+		return nil, err
 	}
-	return
+	return socket, nil
 }
 
 func writeDataFrame(event *FileEvent, sequence uint32, output io.Writer) {
 	//emit("event: %s\n", *event.Text)
+	pairs := eventPairs(event)
+
 	// header, "1D"
 	output.Write([]byte("1D"))
 	// sequence number
 	binary.Write(output, binary.BigEndian, uint32(sequence))
 	// 'pair' count
-	binary.Write(output, binary.BigEndian, uint32(len(*event.Fields)+4))
+	binary.Write(output, binary.BigEndian, uint32(len(pairs)))
+
+	for _, pair := range pairs {
+		// v1 frames only carry strings, so anything else is sent as JSON
+		value, ok := pair.value.(string)
+		if !ok {
+			encoded, _ := json.Marshal(pair.value)
+			value = string(encoded)
+		}
+		writeKV(pair.key, value, output)
+	}
+}
+
+type eventPair struct {
+	key   string
+	value interface{}
+}
+
+// Return the key/value pairs to publish for an event. Keys decoded from a
+// JSON line replace any others with the same name.
+func eventPairs(event *FileEvent) []eventPair {
+	pairs := make([]eventPair, 0, len(*event.Fields)+len(event.Decoded)+5)
+	add := func(key string, value interface{}) {
+		if _, decoded := event.Decoded[key]; !decoded {
+			pairs = append(pairs, eventPair{key, value})
+		}
+	}
 
-	writeKV("file", *event.Source, output)
-	writeKV("host", hostname, output)
-	writeKV("offset", strconv.FormatInt(event.Offset, 10), output)
-	writeKV("line", *event.Text, output)
+	add("file", *event.Source)
+	add("host", hostname)
+	add("offset", event.Offset)
+	add("line", *event.Text)
+	if event.Truncated {
+		add("truncated", true)
+	}
 	for k, v := range *event.Fields {
-		writeKV(k, v, output)
+		add(k, v)
+	}
+
+	keys := make([]string, 0, len(event.Decoded))
+	for k := range event.Decoded {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pairs = append(pairs, eventPair{k, event.Decoded[k]})
 	}
+	return pairs
 }
 
 func writeKV(key string, value string, output io.Writer) {
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Publishv2 speaks version 2 of the lumberjack protocol. Events are sent as
+// JSON frames, so values keep their types and can be nested, and the server
+// may acknowledge part of a window. When only part of a window is
+// acknowledged before an error, the registrar is told about that part and
+// the rest is sent again.
+func Publishv2(input chan []*FileEvent,
+	registrar chan []*FileEvent,
+	config *NetworkConfig) [][]*FileEvent {
+	var socket net.Conn
+	var sequence uint32
+
+	socket = connect(config)
+	defer func() {
+		if socket != nil {
+			socket.Close()
+		}
+	}()
+
+	for events := range input {
+		if socket != nil {
+			socket = failback(socket, config)
+		}
+
+		for len(events) != 0 {
+			if socket == nil {
+				return unpublished(input, events)
+			}
+			acked, err := sendWindowv2(socket, events, &sequence, config)
+
+			// Tell the registrar about what was acknowledged, and send the rest again
+			if acked != 0 {
+				registrar <- events[:acked]
+				events = events[acked:]
+			}
+
+			if err != nil {
+				emit("Socket error, will reconnect: %s\n", err)
+				time.Sleep(1 * time.Second)
+				socket.Close()
+				socket = connect(config)
+			}
+		}
+	} /* for each event payload */
+	return nil
+} // Publishv2
+
+// Send events as a single window and wait until the server acknowledges all
+// of them. Returns how many of events were acknowledged, counting the events
+// that are not sent along with the sent event after them, and any error
+// that stopped us waiting.
+func sendWindowv2(socket net.Conn, events []*FileEvent, sequence *uint32, config *NetworkConfig) (int, error) {
+	w := newWindow(events)
+	if w.count() == 0 {
+		return len(events), nil
+	}
+
+	frame, err := w.encode(2, sequence)
+	if err != nil {
+		return 0, err
+	}
+
+	// Abort if our whole request takes longer than the configured
+	// network timeout.
+	socket.SetDeadline(time.Now().Add(config.timeout))
+	if _, err := socket.Write(frame); err != nil {
+		return 0, err
+	}
+
+	// Read acks until the whole window is acknowledged
+	for !w.complete() {
+		ack, err := readAck(socket, 2)
+		if err == nil && !w.ack(ack) && ack != 0 {
+			err = fmt.Errorf("ack for sequence %d, outside of window %d to %d", ack, w.first, w.last())
+		}
+		if err != nil {
+			return len(w.release()), err
+		}
+
+		// The server is making progress, or sent a keepalive (a zero ack)
+		// while it works on the window, so give it longer
+		socket.SetDeadline(time.Now().Add(config.timeout))
+	}
+
+	return len(events), nil
+}
+
+func writeJSONFrame(event *FileEvent, sequence uint32, output io.Writer) error {
+	object := make(map[string]interface{})
+	for _, pair := range eventPairs(event) {
+		object[pair.key] = pair.value
+	}
+	payload, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	// header, "2J"
+	output.Write([]byte("2J"))
+	// sequence number
+	binary.Write(output, binary.BigEndian, uint32(sequence))
+	// payload length
+	binary.Write(output, binary.BigEndian, uint32(len(payload)))
+	_, err = output.Write(payload)
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// A received v2 data frame.
+type frameV2 struct {
+	sequence uint32
+	object   map[string]interface{}
+}
+
+// Read a window sent by sendWindowv2, returning its data frames.
+func readWindowv2(conn io.Reader) ([]frameV2, error) {
+	var header struct {
+		Version, Type byte
+		Value         uint32
+	}
+
+	if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != '2' || header.Type != 'W' {
+		return nil, fmt.Errorf("expected a window frame, got %c%c", header.Version, header.Type)
+	}
+	count := header.Value
+
+	if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != '2' || header.Type != 'C' {
+		return nil, fmt.Errorf("expected a compressed frame, got %c%c", header.Version, header.Type)
+	}
+	decompressor, err := zlib.NewReader(io.LimitReader(conn, int64(header.Value)))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(payload)
+	frames := make([]frameV2, count)
+	for i := range frames {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+		if header.Version != '2' || header.Type != 'J' {
+			return nil, fmt.Errorf("expected a JSON frame, got %c%c", header.Version, header.Type)
+		}
+		binary.Read(reader, binary.BigEndian, &length)
+		data := make([]byte, length)
+		io.ReadFull(reader, data)
+
+		frames[i].sequence = header.Value
+		if err := json.Unmarshal(data, &frames[i].object); err != nil {
+			return nil, err
+		}
+	}
+	return frames, nil
+}
+
+func writeAckv2(conn io.Writer, sequence uint32) {
+	conn.Write([]byte("2A"))
+	binary.Write(conn, binary.BigEndian, sequence)
+}
+
+func makeEvents(texts ...string) []*FileEvent {
+	source := "/var/log/test.log"
+	fields := map[string]string{"type": "test"}
+	events := make([]*FileEvent, len(texts))
+	for i := range texts {
+		if texts[i] == "" {
+			// An event for dropped lines
+			events[i] = &FileEvent{Source: &source, Dropped: true, Fields: &fields}
+		} else {
+			events[i] = &FileEvent{Source: &source, Text: &texts[i], Offset: int64(i), Fields: &fields}
+		}
+	}
+	return events
+}
+
+func TestSendWindowv2(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	config := &NetworkConfig{timeout: 5 * time.Second}
+
+	received := make(chan []frameV2, 1)
+	go func() {
+		frames, err := readWindowv2(server)
+		if err != nil {
+			t.Errorf("Error reading window: %s", err)
+		}
+		received <- frames
+		// A keepalive, then a partial and a full ack
+		writeAckv2(server, 0)
+		writeAckv2(server, frames[0].sequence)
+		writeAckv2(server, frames[len(frames)-1].sequence)
+	}()
+
+	var sequence uint32 = 41
+	events := makeEvents("one", "", "two")
+	acked, err := sendWindowv2(client, events, &sequence, config)
+	if err != nil {
+		t.Fatalf("Unexpected error sending window: %s", err)
+	}
+	if acked != len(events) {
+		t.Fatalf("Expected all %d events to be acked, got %d", len(events), acked)
+	}
+
+	frames := <-received
+	if len(frames) != 2 {
+		t.Fatalf("Expected the dropped event not to be sent, got %d frames", len(frames))
+	}
+	if frames[0].sequence != 42 || frames[1].sequence != 43 || sequence != 43 {
+		t.Errorf("Expected sequences 42 and 43, got %d and %d", frames[0].sequence, frames[1].sequence)
+	}
+	object := frames[1].object
+	if object["line"] != "two" || object["type"] != "test" || object["offset"] != float64(2) {
+		t.Errorf("Unexpected frame contents %v", object)
+	}
+}
+
+func TestSendWindowv2PartialAck(t *testing.T) {
+	client, server := net.Pipe()
+	config := &NetworkConfig{timeout: 5 * time.Second}
+
+	go func() {
+		frames, _ := readWindowv2(server)
+		// Ack the first two events, then go away
+		writeAckv2(server, frames[1].sequence)
+		server.Close()
+	}()
+
+	var sequence uint32
+	events := makeEvents("one", "two", "", "three", "four")
+	acked, err := sendWindowv2(client, events, &sequence, config)
+	if err == nil {
+		t.Fatalf("Expected an error when the connection closed")
+	}
+	// The dropped event after "two" is held back with "three", as it may
+	// record an offset past "three"
+	if acked != 2 {
+		t.Fatalf("Expected 2 events to be acked, got %d", acked)
+	}
+}
+
+func TestSendWindowv2BadAck(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	config := &NetworkConfig{timeout: 5 * time.Second}
+
+	go func() {
+		readWindowv2(server)
+		writeAckv2(server, 1000)
+	}()
+
+	var sequence uint32
+	acked, err := sendWindowv2(client, makeEvents("one", "two"), &sequence, config)
+	if err == nil || acked != 0 {
+		t.Fatalf("Expected an error and nothing acked for an ack outside the window, got %d, %v", acked, err)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	queueSegmentSuffix = ".segment"
+	queueCursorFile    = "cursor"
+)
+
+// A queue of spooled events on disk, between the spooler and the publisher,
+// so harvesters carry on while the servers are down. Each batch is appended
+// as a line of JSON to the last of a series of segment files, then read back
+// and handed to the publisher in order. The cursor records how much of the
+// queue has been acknowledged: what comes after it is published again after a
+// restart, and segments before it are removed.
+type diskQueue struct {
+	config   *QueueConfig
+	segments []*queueSegment // oldest first, the last being written to
+	writer   *os.File
+	size     int64 // bytes in all segments, acknowledged or not
+
+	cursor  queueCursor    // the first event not acknowledged
+	sending queueCursor    // the first event not handed to the publisher
+	pending []*queuedBatch // handed to the publisher, not acknowledged
+
+	reader        *os.File
+	readerSegment uint64
+
+	// The position of each file after its last queued event
+	queued map[string]*FileState
+}
+
+type queueSegment struct {
+	number uint64
+	size   int64
+}
+
+type queueCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	// The number of events of the batch at Offset that were acknowledged
+	Acked int `json:"acked"`
+}
+
+// A batch read back from the queue.
+type queuedBatch struct {
+	start  queueCursor
+	end    int64 // the offset of the next batch in the segment
+	total  int   // events in the batch, including those acknowledged before
+	events []*FileEvent
+}
+
+// How an event is written to the queue, with the ids of its file that the
+// registrar records, as its fileinfo can't be written.
+type queuedEvent struct {
+	*FileEvent
+	File *FileState `json:"file,omitempty"`
+}
+
+// Open the queue in the directory config.Path, creating it if need be, and
+// check every batch not acknowledged yet can be read. A batch that was only
+// partly written is removed.
+func openQueue(config *QueueConfig) (q *diskQueue, err error) {
+	if err = os.MkdirAll(config.Path, 0700); err != nil {
+		return nil, err
+	}
+	q = &diskQueue{config: config, queued: make(map[string]*FileState)}
+
+	names, err := filepath.Glob(filepath.Join(config.Path, "*"+queueSegmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		number, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), queueSegmentSuffix), 10, 64)
+		if err != nil {
+			emit("Ignoring unexpected file in the queue: %s\n", name)
+			continue
+		}
+		q.segments = append(q.segments, &queueSegment{number: number})
+	}
+	sort.Sort(bySegmentNumber(q.segments))
+
+	data, err := ioutil.ReadFile(filepath.Join(config.Path, queueCursorFile))
+	switch {
+	case os.IsNotExist(err):
+		if len(q.segments) > 0 {
+			q.cursor.Segment = q.segments[0].number
+		} else {
+			q.cursor.Segment = 1
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(data, &q.cursor); err != nil {
+			return nil, fmt.Errorf("invalid queue cursor: %s", err)
+		}
+	}
+	if err = q.removeAcknowledged(); err != nil {
+		return nil, err
+	}
+
+	for _, segment := range q.segments {
+		if err = q.check(segment); err != nil {
+			return nil, err
+		}
+		q.size += segment.size
+	}
+	if len(q.segments) == 0 || q.segments[len(q.segments)-1].number < q.cursor.Segment {
+		q.segments = append(q.segments, &queueSegment{number: q.cursor.Segment})
+	}
+	last := q.segments[len(q.segments)-1]
+	if q.writer, err = os.OpenFile(q.segmentPath(last.number), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+
+	q.sending = q.cursor
+	emit("Opened queue %s with %d bytes in %d segments\n", config.Path, q.size, len(q.segments))
+	return q, nil
+}
+
+type bySegmentNumber []*queueSegment
+
+func (s bySegmentNumber) Len() int           { return len(s) }
+func (s bySegmentNumber) Less(i, j int) bool { return s[i].number < s[j].number }
+func (s bySegmentNumber) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (q *diskQueue) segmentPath(number uint64) string {
+	return filepath.Join(q.config.Path, fmt.Sprintf("%020d%s", number, queueSegmentSuffix))
+}
+
+// Read every batch of the segment after the cursor, noting where each file
+// was queued up to, and cut the segment short at the first batch that can't
+// be read.
+func (q *diskQueue) check(segment *queueSegment) error {
+	file, err := os.OpenFile(q.segmentPath(segment.number), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(record) == 0 {
+			break
+		}
+		var events []*FileEvent
+		if err == nil {
+			events, err = decodeQueued(record)
+		} else if err == io.EOF {
+			err = fmt.Errorf("incomplete batch")
+		}
+		if err != nil {
+			emit("WARNING: Discarding the end of queue segment %d from offset %d: %s\n", segment.number, offset, err)
+			if err = file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		if segment.number > q.cursor.Segment || offset >= q.cursor.Offset {
+			if segment.number == q.cursor.Segment && offset == q.cursor.Offset && q.cursor.Acked <= len(events) {
+				events = events[q.cursor.Acked:]
+			}
+			for _, event := range events {
+				if *event.Source == "-" {
+					continue
+				}
+				state := &FileState{Source: event.Source, Offset: event.Offset + event.RawBytes, Finished: event.Finished}
+				if event.ids != nil {
+					state.Inode, state.Device = event.ids.Inode, event.ids.Device
+				}
+				q.queued[*event.Source] = state
+			}
+		}
+		offset += int64(len(record))
+	}
+	segment.size = offset
+	return nil
+}
+
+// Harvest files from after their last queued event, rather than from their
+// last acknowledged offset, so queued events are not read and queued again.
+// The returned map gives the acknowledged state, if any, for each state
+// replaced in files, which is what the registrar is to persist.
+func (q *diskQueue) resume(files map[string]*FileState) map[*FileState]*FileState {
+	acknowledged := make(map[*FileState]*FileState)
+	for source, state := range q.queued {
+		acknowledged[state] = files[source]
+		files[source] = state
+	}
+	q.queued = nil
+	return acknowledged
+}
+
+// Append a batch of events to the queue, starting a new segment if it would
+// not fit in the last one.
+func (q *diskQueue) append(events []*FileEvent) error {
+	record, err := encodeQueued(events)
+	if err != nil {
+		return err
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+int64(len(record)) > q.config.SegmentSize {
+		if err = q.startSegment(last.number + 1); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	if _, err = q.writer.Write(record); err != nil {
+		// Don't leave part of the batch behind
+		q.writer.Truncate(last.size)
+		return err
+	}
+	last.size += int64(len(record))
+	q.size += int64(len(record))
+	if q.config.Fsync == "always" {
+		if err = q.writer.Sync(); err != nil {
+			emit("WARNING: (continuing) sync of queue segment %d returned error: %s\n", last.number, err)
+		}
+	}
+	return nil
+}
+
+func (q *diskQueue) startSegment(number uint64) error {
+	if q.config.Fsync != "never" {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+	}
+	writer, err := os.OpenFile(q.segmentPath(number), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	q.writer.Close()
+	q.writer = writer
+	q.segments = append(q.segments, &queueSegment{number: number})
+	return nil
+}
+
+// Read the next batch to hand to the publisher, if there is one.
+func (q *diskQueue) next() (*queuedBatch, error) {
+	for {
+		segment := q.segment(q.sending.Segment)
+		if segment == nil {
+			return nil, nil
+		}
+		if q.sending.Offset < segment.size {
+			break
+		}
+		if segment == q.segments[len(q.segments)-1] {
+			return nil, nil
+		}
+		q.sending = queueCursor{Segment: q.sending.Segment + 1}
+	}
+
+	if q.reader == nil || q.readerSegment != q.sending.Segment {
+		if q.reader != nil {
+			q.reader.Close()
+		}
+		reader, err := os.Open(q.segmentPath(q.sending.Segment))
+		if err != nil {
+			return nil, err
+		}
+		q.reader, q.readerSegment = reader, q.sending.Segment
+	}
+	if _, err := q.reader.Seek(q.sending.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	record, err := bufio.NewReader(q.reader).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	events, err := decodeQueued(record)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &queuedBatch{start: q.sending, end: q.sending.Offset + int64(len(record)), total: len(events)}
+	if q.sending.Acked <= len(events) {
+		batch.events = events[q.sending.Acked:]
+	}
+	q.sending = queueCursor{Segment: q.sending.Segment, Offset: batch.end}
+	return batch, nil
+}
+
+func (q *diskQueue) segment(number uint64) *queueSegment {
+	for _, segment := range q.segments {
+		if segment.number == number {
+			return segment
+		}
+	}
+	return nil
+}
+
+// Record that count more events were acknowledged, moving the cursor past
+// them and removing the segments it left behind.
+func (q *diskQueue) ack(count int) error {
+	for count > 0 && len(q.pending) > 0 {
+		batch := q.pending[0]
+		if left := batch.total - batch.start.Acked; count >= left {
+			count -= left
+			q.cursor = queueCursor{Segment: batch.start.Segment, Offset: batch.end}
+			q.pending = q.pending[1:]
+		} else {
+			batch.start.Acked += count
+			count = 0
+			q.cursor = batch.start
+		}
+	}
+	if err := q.writeCursor(); err != nil {
+		return err
+	}
+	return q.removeAcknowledged()
+}
+
+func (q *diskQueue) writeCursor() error {
+	path := filepath.Join(q.config.Path, queueCursorFile)
+	data, err := json.Marshal(q.cursor)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path + ".new")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(data); err != nil {
+		return err
+	}
+	if q.config.Fsync == "always" {
+		if err = file.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path+".new", path)
+}
+
+// Remove the segments before the cursor, as every event in them was
+// acknowledged.
+func (q *diskQueue) removeAcknowledged() error {
+	for len(q.segments) > 0 && q.segments[0].number < q.cursor.Segment {
+		if err := os.Remove(q.segmentPath(q.segments[0].number)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.size -= q.segments[0].size
+		q.segments = q.segments[1:]
+	}
+	return nil
+}
+
+// Return true if nothing is left to hand to the publisher or to be
+// acknowledged.
+func (q *diskQueue) empty() bool {
+	last := q.segments[len(q.segments)-1]
+	return len(q.pending) == 0 && q.sending.Segment == last.number && q.sending.Offset >= last.size
+}
+
+func (q *diskQueue) close() {
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	if q.config.Fsync != "never" {
+		q.writer.Sync()
+	}
+	q.writer.Close()
+}
+
+// Queue the batches of events from input, hand them to the publisher through
+// output, and pass them on to the registrar once the publisher sends them
+// back to acks. When the queue reaches its maximum size, no more batches are
+// taken from input until some are acknowledged. Returns, closing output and
+// registrar, once input is closed and every event was acknowledged.
+func (q *diskQueue) run(input chan []*FileEvent, output chan []*FileEvent, acks chan []*FileEvent, registrar chan []*FileEvent) {
+	defer q.close()
+
+	var next *queuedBatch
+	var unwritten []*FileEvent
+	var retry <-chan time.Time
+	full := false
+	for {
+		if next == nil {
+			var err error
+			if next, err = q.next(); err != nil {
+				// Skip the rest of a segment that can't be read
+				emit("WARNING: Skipping the rest of queue segment %d: %s\n", q.sending.Segment, err)
+				if last := q.segments[len(q.segments)-1]; q.sending.Segment < last.number {
+					q.sending = queueCursor{Segment: q.sending.Segment + 1}
+				} else {
+					q.sending = queueCursor{Segment: last.number, Offset: last.size}
+				}
+				continue
+			}
+		}
+		if input == nil && q.empty() {
+			close(output)
+			close(registrar)
+			return
+		}
+
+		in := input
+		if unwritten != nil {
+			in = nil
+		} else if backlog := q.size - q.cursor.Offset; backlog >= q.config.MaxSize {
+			if !full {
+				emit("Queue is full with %d bytes, waiting for events to be acknowledged\n", backlog)
+			}
+			full = true
+			in = nil
+		} else {
+			full = false
+		}
+		out := output
+		var events []*FileEvent
+		if next != nil {
+			events = next.events
+		} else {
+			out = nil
+		}
+
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				input = nil
+				continue
+			}
+			if err := q.append(batch); err != nil {
+				emit("Failed to queue %d events, trying again in a second: %s\n", len(batch), err)
+				unwritten, retry = batch, time.After(time.Second)
+			}
+		case <-retry:
+			if err := q.append(unwritten); err != nil {
+				emit("Failed to queue %d events, trying again in a second: %s\n", len(unwritten), err)
+				retry = time.After(time.Second)
+			} else {
+				unwritten, retry = nil, nil
+			}
+		case out <- events:
+			q.pending = append(q.pending, next)
+			next = nil
+		case acked := <-acks:
+			if err := q.ack(len(acked)); err != nil {
+				emit("WARNING: (continuing) update of the queue cursor returned error: %s\n", err)
+			}
+			registrar <- acked
+		}
+	}
+}
+
+func encodeQueued(events []*FileEvent) ([]byte, error) {
+	record := make([]queuedEvent, len(events))
+	for i, event := range events {
+		record[i].FileEvent = event
+		if event.fileinfo != nil {
+			record[i].File = &FileState{}
+			record[i].File.Inode, record[i].File.Device = file_ids(event.fileinfo)
+		} else {
+			record[i].File = event.ids
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func decodeQueued(data []byte) ([]*FileEvent, error) {
+	var record []queuedEvent
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep decoded JSON numbers as they were read
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+
+	events := make([]*FileEvent, len(record))
+	for i, queued := range record {
+		if queued.FileEvent == nil || queued.Source == nil {
+			return nil, fmt.Errorf("event %d has no source", i)
+		}
+		events[i] = queued.FileEvent
+		events[i].ids = queued.File
+		if events[i].Fields == nil {
+			// Files without fields share a nil map, which is written as null
+			events[i].Fields = &map[string]string{}
+		}
+	}
+	return events, nil
+}
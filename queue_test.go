@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-queue")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	// Small segments, so each batch gets one of its own
+	config := &QueueConfig{Path: dir, SegmentSize: 100, MaxSize: 1 << 20, Fsync: "always"}
+	q, err := openQueue(config)
+	chkerr(t, err)
+	batches := [][]*FileEvent{makeEvents("one", "two"), makeEvents("three", "four"), makeEvents("five", "")}
+	batches[2][1].Offset, batches[2][1].RawBytes = 100, 20
+	for _, batch := range batches {
+		chkerr(t, q.append(batch))
+	}
+
+	// The first batch and part of the second are acknowledged
+	for i := 0; i < 2; i++ {
+		batch, err := q.next()
+		chkerr(t, err)
+		q.pending = append(q.pending, batch)
+	}
+	chkerr(t, q.ack(3))
+	q.close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+queueSegmentSuffix))
+	if len(segments) != 2 {
+		t.Errorf("Expected the acknowledged segment to be removed, got %v", segments)
+	}
+
+	// Restart, and only what was not acknowledged is published
+	q, err = openQueue(config)
+	chkerr(t, err)
+	defer q.close()
+	files := map[string]*FileState{}
+	q.resume(files)
+	if state := files["/var/log/test.log"]; state == nil || state.Offset != 120 {
+		t.Errorf("Expected to resume harvesting after the last queued event, got %+v", state)
+	}
+
+	var replayed []*FileEvent
+	for {
+		batch, err := q.next()
+		chkerr(t, err)
+		if batch == nil {
+			break
+		}
+		replayed = append(replayed, batch.events...)
+	}
+	expected := []string{"four", "five", ""}
+	if len(replayed) != len(expected) {
+		t.Fatalf("Expected %d events to be replayed, got %d", len(expected), len(replayed))
+	}
+	for i, event := range replayed {
+		if (event.Text == nil) != (expected[i] == "") || (event.Text != nil && *event.Text != expected[i]) {
+			t.Errorf("Expected event %d to be %q, got %+v", i, expected[i], event)
+		}
+	}
+	if !replayed[2].Dropped || (*replayed[0].Fields)["type"] != "test" {
+		t.Errorf("Expected the events to be read back as they were queued")
+	}
+}
+
+func TestQueueIncompleteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-queue")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &QueueConfig{Path: dir, SegmentSize: 1 << 20, MaxSize: 1 << 20, Fsync: "never"}
+	q, err := openQueue(config)
+	chkerr(t, err)
+	chkerr(t, q.append(makeEvents("one")))
+	q.close()
+
+	// A crash while writing leaves part of a batch behind
+	segment := filepath.Join(dir, "00000000000000000001"+queueSegmentSuffix)
+	file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+	chkerr(t, err)
+	file.WriteString(`[{"source":"/var/log/test.log","te`)
+	file.Close()
+
+	q, err = openQueue(config)
+	chkerr(t, err)
+	defer q.close()
+	batch, err := q.next()
+	chkerr(t, err)
+	if batch == nil || len(batch.events) != 1 {
+		t.Fatalf("Expected the complete batch to be kept")
+	}
+	if batch, err = q.next(); batch != nil || err != nil {
+		t.Errorf("Expected the incomplete batch to be discarded, got %v, %v", batch, err)
+	}
+}
+
+func TestQueueRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-queue")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	// The queue is full after one batch
+	q, err := openQueue(&QueueConfig{Path: dir, SegmentSize: 10, MaxSize: 10, Fsync: "segment"})
+	chkerr(t, err)
+
+	input := make(chan []*FileEvent)
+	output := make(chan []*FileEvent)
+	acks := make(chan []*FileEvent)
+	registrar := make(chan []*FileEvent, 2)
+	go q.run(input, output, acks, registrar)
+
+	input <- makeEvents("one", "two")
+	select {
+	case input <- makeEvents("three"):
+		t.Fatalf("Expected the full queue to take no more events")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	events := <-output
+	acks <- events
+	input <- makeEvents("three")
+	close(input)
+	acks <- <-output
+
+	if _, ok := <-output; ok {
+		t.Errorf("Expected output to be closed once every event was acknowledged")
+	}
+	if len(registrar) != 2 || len(<-registrar) != 2 {
+		t.Errorf("Expected both batches to be passed to the registrar")
+	}
+}
+
+func TestQueueReplayWithoutFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-queue")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &QueueConfig{Path: dir, SegmentSize: 1 << 20, MaxSize: 1 << 20, Fsync: "never"}
+	q, err := openQueue(config)
+	chkerr(t, err)
+	events := makeEvents("one")
+	events[0].Fields = nil
+	chkerr(t, q.append(events))
+	q.close()
+
+	// Events of files without fields are read back with no fields, not nil
+	q, err = openQueue(config)
+	chkerr(t, err)
+	defer q.close()
+	batch, err := q.next()
+	chkerr(t, err)
+	if batch == nil || len(batch.events) != 1 {
+		t.Fatalf("Expected the queued event to be read back")
+	}
+	if fields := batch.events[0].Fields; fields == nil || len(*fields) != 0 {
+		t.Errorf("Expected the event to be read back with no fields, got %v", fields)
+	}
+}
@@ -5,8 +5,27 @@ import (
 	"encoding/json"
 )
 
-func Registrar(state map[string]*FileState, input chan []*FileEvent) {
-	for events := range input {
+// Record where the events from input were read up to, until input or stop
+// is closed, then write the registry one last time.
+func Registrar(state map[string]*FileState, input chan []*FileEvent, stop chan struct{}) {
+	defer func() {
+		if e := writeRegistry(state, ".logstash-forwarder"); e != nil {
+			emit("WARNING: final update of registry returned error: %s", e)
+		}
+	}()
+
+	for {
+		var events []*FileEvent
+		select {
+		case batch, ok := <-input:
+			if !ok {
+				return
+			}
+			events = batch
+		case <-stop:
+			return
+		}
+
 		emit ("Registrar: processing %d events\n", len(events))
 		// Take the last event found for each file source
 		for _, event := range events {
@@ -15,16 +34,21 @@ func Registrar(state map[string]*FileState, input chan []*FileEvent) {
 				continue
 			}
 
-			ino, dev := file_ids(event.fileinfo)
-			state[*event.Source] = &FileState{
+			next := &FileState{
 				Source: event.Source,
-				// take the offset + length of the line + newline char and
-				// save it as the new starting offset.
-				// This issues a problem, if the EOL is a CRLF! Then on start it read the LF again and generates a event with an empty line
-				Offset: event.Offset + int64(len(*event.Text)) + 1, // REVU: this is begging for BUGs
-				Inode:  ino,
-				Device: dev,
+				// take the offset + the raw bytes read for the event (which
+				// includes any CRLF or LF, and every line of a multiline event)
+				// and save it as the new starting offset.
+				Offset: event.Offset + event.RawBytes,
+				// compressed files are only read once
+				Finished: event.Finished,
+			}
+			if event.fileinfo != nil {
+				next.Inode, next.Device = file_ids(event.fileinfo)
+			} else if event.ids != nil {
+				next.Inode, next.Device = event.ids.Inode, event.ids.Device
 			}
+			state[*event.Source] = next
 			//log.Printf("State %s: %d\n", *event.Source, event.Offset)
 		}
 
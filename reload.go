@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Discover, load and merge the config files of -config, as at startup and
+// again on SIGHUP.
+func loadConfigs(config_arg string) (config Config, err error) {
+	config_files, err := DiscoverConfigs(config_arg)
+	if err != nil {
+		return config, fmt.Errorf("could not use -config of '%s': %s", config_arg, err)
+	}
+
+	for _, filename := range config_files {
+		additional_config, err := LoadConfig(filename)
+		if err == nil {
+			err = MergeConfig(&config, additional_config)
+		}
+		if err != nil {
+			return config, fmt.Errorf("could not load config file %s: %s", filename, err)
+		}
+	}
+	FinalizeConfig(&config)
+
+	if len(config.Files) == 0 {
+		return config, fmt.Errorf("no paths given. What files do you want me to watch?")
+	}
+	if _, err = publisherFor(&config.Network); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// Load the positions recorded in the registry, if there is one.
+func loadRegistry(path string) map[string]*FileState {
+	files := make(map[string]*FileState)
+	if existing, e := os.Open(path); e == nil {
+		defer existing.Close()
+		wd := ""
+		if wd, e = os.Getwd(); e != nil {
+			emit("WARNING: os.Getwd retuned unexpected error %s -- ignoring\n", e.Error())
+		}
+		emit("Loading registrar data from %s/%s\n", wd, path)
+
+		decoder := json.NewDecoder(existing)
+		decoder.Decode(&files)
+	}
+	return files
+}
+
+// A publisher sends the batches of events from input to the servers of
+// config, and passes them on to registrar once they are acknowledged. It
+// returns once input is closed and everything was published, or when it is
+// replaced and can't connect, with the batches it did not publish.
+type publisher func(input chan []*FileEvent, registrar chan []*FileEvent, config *NetworkConfig) [][]*FileEvent
+
+// Return the publisher to use for the network config.
+func publisherFor(network *NetworkConfig) (publisher, error) {
+	switch {
+	case network.Protocol != 1 && network.Protocol != 2:
+		return nil, fmt.Errorf("unsupported lumberjack protocol version: %d", network.Protocol)
+	case network.WindowsInFlight < 1:
+		return nil, fmt.Errorf("windows in flight must be at least 1, not %d", network.WindowsInFlight)
+	case network.LoadBalance == "round-robin" || network.LoadBalance == "least-pending":
+		return PublishBalanced, nil
+	case network.LoadBalance != "":
+		return nil, fmt.Errorf("unsupported load balance mode: %s", network.LoadBalance)
+	case network.WindowsInFlight > 1:
+		return PublishPipelined, nil
+	case network.Protocol == 1:
+		return Publishv1, nil
+	default:
+		return Publishv2, nil
+	}
+}
+
+// Publish the batches of events from input with the publisher for the network
+// config, until a new network config arrives on reconnect. The publisher is
+// then left to finish with what it was given, so the registrar still gets
+// events in order, and one for the new config takes over, starting with what
+// the old one gave up on if it could not connect. Closes registrar once input
+// is closed and everything was published.
+func Publish(input chan []*FileEvent, registrar chan []*FileEvent, config *NetworkConfig, reconnect chan *NetworkConfig) {
+	var pending [][]*FileEvent
+	for {
+		publish, _ := publisherFor(config)
+		publisher_chan := make(chan []*FileEvent, 1)
+		config.stop = make(chan struct{})
+		done := make(chan [][]*FileEvent, 1)
+		go func(config *NetworkConfig) {
+			done <- publish(publisher_chan, registrar, config)
+		}(config)
+
+		next := config
+		for next == config {
+			in, out := input, publisher_chan
+			var first []*FileEvent
+			if len(pending) == 0 {
+				out = nil
+			} else {
+				in = nil
+				first = pending[0]
+			}
+			select {
+			case events, ok := <-in:
+				if !ok {
+					close(publisher_chan)
+					<-done
+					close(registrar)
+					return
+				}
+				pending = append(pending, events)
+			case out <- first:
+				pending = pending[1:]
+			case next = <-reconnect:
+			}
+		}
+
+		emit("Reconnecting with the new network config once what was sent is acknowledged\n")
+		close(publisher_chan)
+		close(config.stop)
+		if unpublished := <-done; len(unpublished) != 0 {
+			emit("Sending %d batches of events again with the new network config\n", len(unpublished))
+			pending = append(unpublished, pending...)
+		}
+		config = next
+	}
+}
+
+// The prospectors running for each file config, which SIGHUP replaces with
+// those of the config files as they are now.
+type harvesting struct {
+	config      Config
+	prospectors map[string][]*Prospector // by fileConfigKey
+	output      chan *FileEvent
+	reconnect   chan *NetworkConfig
+}
+
+func newHarvesting(config Config, output chan *FileEvent) *harvesting {
+	return &harvesting{
+		config:      config,
+		prospectors: make(map[string][]*Prospector),
+		output:      output,
+		reconnect:   make(chan *NetworkConfig, 1),
+	}
+}
+
+// Two file configs with the same key are the same, after defaults are set.
+func fileConfigKey(fileconfig FileConfig) string {
+	key, _ := json.Marshal(fileconfig)
+	return string(key)
+}
+
+// Start a prospector for each file config, resuming files from where resume
+// says. Returns how many were started.
+func (h *harvesting) start(fileconfigs []FileConfig, resume *ProspectorResume) int {
+	for _, fileconfig := range fileconfigs {
+		key := fileConfigKey(fileconfig)
+		prospector := newProspector(fileconfig)
+		h.prospectors[key] = append(h.prospectors[key], prospector)
+		go prospector.Prospect(resume, h.output)
+	}
+	return len(fileconfigs)
+}
+
+// Stop every prospector and its harvesters.
+func (h *harvesting) stop() {
+	for _, prospectors := range h.prospectors {
+		for _, prospector := range prospectors {
+			prospector.Stop()
+		}
+	}
+}
+
+// Switch to a new config: stop the prospectors of file configs that are gone,
+// start prospectors for new ones, and have the publisher reconnect if the
+// network config changed. Events already harvested are still published, and
+// files harvested by a stopped prospector are resumed from its last event.
+func (h *harvesting) reload(config Config, registry string) {
+	wanted := make(map[string]int)
+	var added []FileConfig
+	for _, fileconfig := range config.Files {
+		key := fileConfigKey(fileconfig)
+		wanted[key]++
+		if wanted[key] > len(h.prospectors[key]) {
+			added = append(added, fileconfig)
+		}
+	}
+
+	resume := &ProspectorResume{files: loadRegistry(registry), persist: make(chan *FileState)}
+	stopped := 0
+	for key, prospectors := range h.prospectors {
+		for len(prospectors) > wanted[key] {
+			prospector := prospectors[len(prospectors)-1]
+			prospectors = prospectors[:len(prospectors)-1]
+			prospector.Stop()
+			for source, state := range prospector.finalStates() {
+				resume.files[source] = state
+			}
+			stopped++
+		}
+		if len(prospectors) == 0 {
+			delete(h.prospectors, key)
+		} else {
+			h.prospectors[key] = prospectors
+		}
+	}
+
+	// The registrar already has the states the new prospectors resume from
+	if started := h.start(added, resume); started > 0 {
+		go func() {
+			for state := range resume.persist {
+				if state.Source == nil {
+					if started--; started == 0 {
+						return
+					}
+				}
+			}
+		}()
+	}
+	emit("Reloaded config: stopped %d prospectors, started %d\n", stopped, len(added))
+
+	old_network, _ := json.Marshal(h.config.Network)
+	new_network, _ := json.Marshal(config.Network)
+	if string(old_network) != string(new_network) {
+		// Only the latest config matters if the publisher has not taken the last
+		select {
+		case <-h.reconnect:
+		default:
+		}
+		h.reconnect <- &config.Network
+	}
+
+	old_queue, _ := json.Marshal(h.config.Queue)
+	new_queue, _ := json.Marshal(config.Queue)
+	if string(old_queue) != string(new_queue) {
+		emit("WARNING: changes to the queue config take effect on restart\n")
+		config.Queue = h.config.Queue
+	}
+	h.config = config
+}
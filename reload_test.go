@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, output chan *FileEvent) *FileEvent {
+	select {
+	case event := <-output:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	return nil
+}
+
+func TestHarvestingReload(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	file := filepath.Join(tmpdir, "app.log")
+	chkerr(t, ioutil.WriteFile(file, []byte("one\n"), 0644))
+	fileconfig := func(fields map[string]string) FileConfig {
+		fileconfig := FileConfig{Paths: []string{file}, Fields: fields}
+		chkerr(t, loadFileConfig(&fileconfig))
+		return fileconfig
+	}
+	output := make(chan *FileEvent)
+	config := Config{Files: []FileConfig{fileconfig(nil)}}
+	h := newHarvesting(config, output)
+	resume := &ProspectorResume{files: map[string]*FileState{}, persist: make(chan *FileState, 1)}
+	h.start(config.Files, resume)
+	defer h.stop()
+	if event := nextEvent(t, output); *event.Text != "one" {
+		t.Fatalf("Expected the first line, got %q", *event.Text)
+	}
+
+	// The same file with other fields is harvested by a new prospector, from
+	// after the last line the old one shipped
+	h.reload(Config{Files: []FileConfig{fileconfig(map[string]string{"type": "app"})}}, filepath.Join(tmpdir, "registry"))
+	if len(h.prospectors) != 1 {
+		t.Fatalf("Expected one prospector after reloading, got %d", len(h.prospectors))
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	chkerr(t, err)
+	f.WriteString("two\n")
+	f.Close()
+
+	event := nextEvent(t, output)
+	if *event.Text != "two" || (*event.Fields)["type"] != "app" {
+		t.Errorf("Expected the second line with the new fields, got %q with %v", *event.Text, *event.Fields)
+	}
+	select {
+	case <-h.reconnect:
+		t.Errorf("Expected no reconnect without network changes")
+	default:
+	}
+}
+
+func TestHarvestingReloadStdin(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	file := filepath.Join(tmpdir, "app.log")
+	chkerr(t, ioutil.WriteFile(file, []byte("one\n"), 0644))
+	fileconfig := FileConfig{Paths: []string{"-", file}}
+	chkerr(t, loadFileConfig(&fileconfig))
+
+	output := make(chan *FileEvent)
+	config := Config{Files: []FileConfig{fileconfig}}
+	h := newHarvesting(config, output)
+	resume := &ProspectorResume{files: map[string]*FileState{}, persist: make(chan *FileState, 1)}
+	h.start(config.Files, resume)
+	defer h.stop()
+	if event := nextEvent(t, output); *event.Text != "one" {
+		t.Fatalf("Expected the first line, got %q", *event.Text)
+	}
+
+	// The prospector harvests stdin apart from the other paths, without
+	// touching the config it was started with
+	if !reflect.DeepEqual(fileconfig.Paths, []string{"-", file}) {
+		t.Errorf("Expected the paths of the config to be left alone, got %v", fileconfig.Paths)
+	}
+	h.reload(Config{Files: []FileConfig{fileconfig}}, filepath.Join(tmpdir, "registry"))
+	if prospectors := h.prospectors[fileConfigKey(fileconfig)]; len(h.prospectors) != 1 || len(prospectors) != 1 {
+		t.Errorf("Expected the prospector to be kept when reloading the same config, got %v", h.prospectors)
+	}
+}
+
+func TestPublishReconnectServerDown(t *testing.T) {
+	// A port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	chkerr(t, err)
+	down := closed.Addr().String()
+	closed.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	chkerr(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					frames, err := readWindowv2(conn)
+					if err != nil {
+						return
+					}
+					writeAckv2(conn, frames[len(frames)-1].sequence)
+				}
+			}()
+		}
+	}()
+
+	network := func(server, balance string, windows int) *NetworkConfig {
+		return &NetworkConfig{
+			Servers:          []string{server},
+			Transport:        "tcp",
+			Protocol:         2,
+			LoadBalance:      balance,
+			WindowsInFlight:  windows,
+			ReconnectBackoff: &BackoffConfig{Min: "50ms", Max: "50ms"},
+			timeout:          time.Second,
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		balance string
+		windows int
+	}{
+		{"one window", "", 1},
+		{"pipelined", "", 2},
+		{"balanced", "round-robin", 1},
+	} {
+		old := network(down, test.balance, test.windows)
+		chkerr(t, loadNetworkConfig(old))
+		input := make(chan []*FileEvent)
+		registrar := make(chan []*FileEvent, 10)
+		reconnect := make(chan *NetworkConfig)
+		go Publish(input, registrar, old, reconnect)
+
+		// The old publisher can't send these, so the new one must
+		input <- makeEvents("one", "two")
+		input <- makeEvents("three")
+		replacement := network(listener.Addr().String(), test.balance, test.windows)
+		chkerr(t, loadNetworkConfig(replacement))
+		reconnect <- replacement
+		input <- makeEvents("four")
+		close(input)
+
+		var texts []string
+		timeout := time.After(10 * time.Second)
+		for done := false; !done; {
+			select {
+			case events, ok := <-registrar:
+				if !ok {
+					done = true
+				}
+				for _, event := range events {
+					texts = append(texts, *event.Text)
+				}
+			case <-timeout:
+				t.Fatalf("%s: timed out publishing after replacing a server that is down, got %v", test.name, texts)
+			}
+		}
+		if !reflect.DeepEqual(texts, []string{"one", "two", "three", "four"}) {
+			t.Errorf("%s: expected every event acknowledged once and in order, got %v", test.name, texts)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// A server to publish to, with what is needed to back off from it after
+// failures.
+type server struct {
+	hostport string
+	priority int
+
+	failures  int       // failures since the server was last healthy
+	retry     time.Time // when to try the server again after a failure
+	connected time.Time // when the current connection was made, if any
+}
+
+// Record that connecting to the server failed, or that the connection was
+// lost, and return how long to back off before trying it again. A server
+// that stayed connected for longer than the longest backoff is taken to have
+// recovered from any earlier failures.
+func (s *server) failed(backoff *BackoffConfig) time.Duration {
+	if !s.connected.IsZero() && time.Since(s.connected) > backoff.max {
+		s.failures = 0
+	}
+	s.connected = time.Time{}
+
+	delay := backoff.min
+	for i := 0; i < s.failures && delay < backoff.max; i++ {
+		delay = time.Duration(float64(delay) * backoff.Multiplier)
+	}
+	if delay > backoff.max {
+		delay = backoff.max
+	}
+	s.failures++
+
+	// Wait between half and all of the delay, so forwarders that lost the
+	// same server do not all come back to it at once
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	s.retry = time.Now().Add(delay)
+	return delay
+}
+
+func (s *server) available() bool {
+	return !time.Now().Before(s.retry)
+}
+
+type byPriority []*server
+
+func (s byPriority) Len() int           { return len(s) }
+func (s byPriority) Less(i, j int) bool { return s[i].priority < s[j].priority }
+func (s byPriority) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Return every configured server, highest priority first.
+func configuredServers(config *NetworkConfig) []*server {
+	servers := make([]*server, 0, len(config.Servers))
+	for _, hostport := range config.Servers {
+		servers = append(servers, &server{hostport: hostport})
+	}
+	for _, group := range config.ServerGroups {
+		for _, hostport := range group.Servers {
+			servers = append(servers, &server{hostport: hostport, priority: group.Priority})
+		}
+	}
+	sort.Stable(byPriority(servers))
+	return servers
+}
+
+// The servers a publisher with a single connection picks from.
+type serverPool struct {
+	servers []*server // highest priority first
+	backoff *BackoffConfig
+	current *server // the server connected to, if any
+}
+
+func newServerPool(config *NetworkConfig) *serverPool {
+	return &serverPool{servers: configuredServers(config), backoff: reconnectBackoff(config)}
+}
+
+func reconnectBackoff(config *NetworkConfig) *BackoffConfig {
+	if config.ReconnectBackoff == nil {
+		config.ReconnectBackoff = &BackoffConfig{}
+		loadBackoffConfig("reconnect backoff", config.ReconnectBackoff, defaultConfig.reconnectMin, defaultConfig.reconnectMax)
+	}
+	return config.ReconnectBackoff
+}
+
+// Pick a server at random from the highest priority group with a server not
+// backing off. If every server is backing off, returns nil and how long
+// until the first of them can be tried again.
+func (p *serverPool) pick() (*server, time.Duration) {
+	var candidates []*server
+	var wait time.Duration
+	for _, s := range p.servers {
+		if len(candidates) != 0 && s.priority != candidates[0].priority {
+			break
+		}
+		if s.available() {
+			candidates = append(candidates, s)
+		} else if until := s.retry.Sub(time.Now()); wait == 0 || until < wait {
+			wait = until
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, wait
+	}
+	return candidates[rand.Int()%len(candidates)], 0
+}
+
+// Whether a server of higher priority than the one connected to is ready to
+// be tried again.
+func (p *serverPool) failbackDue() bool {
+	if p.current == nil {
+		return false
+	}
+	for _, s := range p.servers {
+		if s.priority >= p.current.priority {
+			break
+		}
+		if s.available() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerBackoff(t *testing.T) {
+	backoff := &BackoffConfig{Min: "1s", Max: "4s", Multiplier: 2}
+	chkerr(t, loadBackoffConfig("reconnect backoff", backoff, defaultConfig.reconnectMin, defaultConfig.reconnectMax))
+
+	s := &server{hostport: "primary:5043"}
+	for _, full := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		// Jitter takes off up to half of the delay
+		if delay := s.failed(backoff); delay < full/2 || delay > full {
+			t.Errorf("Expected a delay between %v and %v, got %v", full/2, full, delay)
+		}
+		if s.available() {
+			t.Errorf("Expected the server not to be available while backing off")
+		}
+	}
+
+	// A connection that lasted longer than the longest backoff resets it
+	s.connected = time.Now().Add(-time.Minute)
+	if delay := s.failed(backoff); delay > time.Second {
+		t.Errorf("Expected the backoff to start again after a healthy connection, got %v", delay)
+	}
+}
+
+func TestServerPool(t *testing.T) {
+	config := &NetworkConfig{
+		Servers: []string{"primary:5043"},
+		ServerGroups: []ServerGroup{
+			{Priority: 2, Servers: []string{"last:5043"}},
+			{Priority: 1, Servers: []string{"dr-a:5043", "dr-b:5043"}},
+		},
+	}
+	pool := newServerPool(config)
+
+	var order []string
+	for _, s := range pool.servers {
+		order = append(order, s.hostport)
+	}
+	if order[0] != "primary:5043" || order[3] != "last:5043" {
+		t.Fatalf("Expected servers to be sorted by priority, got %v", order)
+	}
+
+	if s, _ := pool.pick(); s != pool.servers[0] {
+		t.Fatalf("Expected the primary to be picked, got %s", s.hostport)
+	}
+
+	// Only the DR group is used while the primary backs off
+	pool.servers[0].retry = time.Now().Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		if s, _ := pool.pick(); s.priority != 1 {
+			t.Fatalf("Expected a DR server to be picked, got %s", s.hostport)
+		}
+	}
+
+	pool.current = pool.servers[1]
+	if pool.failbackDue() {
+		t.Errorf("Expected no failback while the primary backs off")
+	}
+	pool.servers[0].retry = time.Now()
+	if !pool.failbackDue() {
+		t.Errorf("Expected failback once the primary can be tried again")
+	}
+
+	// When every server backs off, wait for the first to be available
+	for _, s := range pool.servers {
+		s.retry = time.Now().Add(time.Hour)
+	}
+	pool.servers[3].retry = time.Now().Add(time.Minute)
+	if s, wait := pool.pick(); s != nil || wait > time.Minute || wait < 59*time.Second {
+		t.Errorf("Expected to wait about a minute for the last server, got %v", wait)
+	}
+}
+
+func TestFailbackKeepsBackup(t *testing.T) {
+	// The primary is a port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	chkerr(t, err)
+	primary := closed.Addr().String()
+	closed.Close()
+
+	backup, err := net.Listen("tcp", "127.0.0.1:0")
+	chkerr(t, err)
+	defer backup.Close()
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := backup.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer conn.Close()
+				for {
+					frames, err := readWindowv2(conn)
+					if err != nil {
+						return
+					}
+					writeAckv2(conn, frames[len(frames)-1].sequence)
+				}
+			}()
+		}
+	}()
+
+	for _, windows := range []int{1, 2} {
+		config := &NetworkConfig{
+			Servers:          []string{primary},
+			ServerGroups:     []ServerGroup{{Priority: 1, Servers: []string{backup.Addr().String()}}},
+			Transport:        "tcp",
+			Protocol:         2,
+			WindowsInFlight:  windows,
+			ReconnectBackoff: &BackoffConfig{Min: "10ms", Max: "10ms"},
+			timeout:          time.Second,
+		}
+		chkerr(t, loadNetworkConfig(config))
+		publish, err := publisherFor(config)
+		chkerr(t, err)
+
+		input := make(chan []*FileEvent)
+		registrar := make(chan []*FileEvent, 10)
+		done := make(chan struct{})
+		go func() {
+			publish(input, registrar, config)
+			close(done)
+		}()
+
+		// The primary is tried again between batches, and stays down
+		batches := 5
+		for i := 0; i < batches; i++ {
+			input <- makeEvents("one")
+			time.Sleep(30 * time.Millisecond)
+		}
+		close(input)
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d windows: timed out publishing to the backup", windows)
+		}
+
+		if len(registrar) != batches {
+			t.Errorf("%d windows: expected %d batches to be acknowledged, got %d", windows, batches, len(registrar))
+		}
+		if len(accepted) != 1 {
+			t.Errorf("%d windows: expected the backup connection to be kept, got %d connections", windows, len(accepted))
+		}
+		for len(accepted) != 0 {
+			<-accepted
+		}
+	}
+}
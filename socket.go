@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Servers given as unix:///path/to/socket are reached over a Unix domain
+// socket rather than TCP.
+const unixScheme = "unix://"
+
+// Connect to a server listening on the Unix domain socket at path. TLS is
+// used unless the transport is "tcp", with the server certificate verified
+// against "ssl server name", or localhost.
+func dialUnix(path string, material *tlsMaterial, config *NetworkConfig) (net.Conn, error) {
+	if err := checkSocket(path); err != nil {
+		emit("Refusing unix socket %s: %s\n", path, err)
+		return nil, err
+	}
+
+	emit("Connecting to unix socket %s\n", path)
+	socket, err := net.DialTimeout("unix", path, config.timeout)
+	if err != nil {
+		emit("Failure connecting to %s: %s\n", path, err)
+		return nil, err
+	}
+
+	if config.Transport != "tcp" {
+		if socket, err = handshake(socket, "localhost", material, config); err != nil {
+			emit("Failed to tls handshake with %s %s\n", path, err)
+			return nil, err
+		}
+	}
+
+	emit("Connected to %s\n", path)
+	return socket, nil
+}
+
+// Check that path is a socket that only root or our own user could have put
+// there, so events are not handed to a listener another user started.
+func checkSocket(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("the socket path must be absolute")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("not a socket (mode %v)", info.Mode())
+	}
+	if err = checkOwner(info); err != nil {
+		return err
+	}
+
+	// Anyone could replace the socket in a directory anyone can write to,
+	// unless it is sticky like /tmp
+	dir := filepath.Dir(path)
+	if info, err = os.Stat(dir); err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0002 != 0 && info.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("anyone may replace it, as %s is world writable (mode %v)", dir, info.Mode())
+	}
+	return nil
+}
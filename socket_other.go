@@ -0,0 +1,20 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func checkOwner(info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if stat.Uid != 0 && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("owned by uid %d, rather than root or uid %d", stat.Uid, os.Getuid())
+	}
+	return nil
+}
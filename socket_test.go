@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-socket")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lumberjack.sock")
+	listener, err := net.Listen("unix", path)
+	chkerr(t, err)
+	defer listener.Close()
+	listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{makeCert("localhost")}})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+			}()
+		}
+	}()
+
+	caCertFile := filepath.Join(dir, "ca.crt")
+	chkerr(t, ioutil.WriteFile(caCertFile, []byte(caCert), 0600))
+	config := &NetworkConfig{SSLCA: caCertFile, timeout: 5 * time.Second}
+	m := &tlsMaterial{config: config}
+	chkerr(t, m.reload())
+
+	socket, err := dial("unix://"+path, m, config)
+	chkerr(t, err)
+	defer socket.Close()
+	if state := socket.(*tls.Conn).ConnectionState(); !state.HandshakeComplete {
+		t.Errorf("Expected a TLS connection over the unix socket")
+	}
+}
+
+func TestCheckSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstash-forwarder-socket")
+	chkerr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lumberjack.sock")
+	listener, err := net.Listen("unix", path)
+	chkerr(t, err)
+	defer listener.Close()
+	chkerr(t, checkSocket(path))
+
+	file := filepath.Join(dir, "lumberjack.log")
+	chkerr(t, ioutil.WriteFile(file, nil, 0600))
+	if err := checkSocket(file); err == nil {
+		t.Errorf("Expected a regular file to be refused")
+	}
+	if err := checkSocket("lumberjack.sock"); err == nil {
+		t.Errorf("Expected a relative path to be refused")
+	}
+
+	// Anyone could have replaced the socket
+	chkerr(t, os.Chmod(dir, 0777))
+	if err := checkSocket(path); err == nil {
+		t.Errorf("Expected a socket in a world writable directory to be refused")
+	}
+	chkerr(t, os.Chmod(dir, 0777|os.ModeSticky))
+	chkerr(t, checkSocket(path))
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os"
+)
+
+// Windows has no owner in os.FileInfo to check.
+func checkOwner(info os.FileInfo) error {
+	return nil
+}
@@ -7,10 +7,15 @@ import (
 func Spool(input chan *FileEvent,
   output chan []*FileEvent,
   max_size uint64,
-  idle_timeout time.Duration) {
+  max_bytes uint64,
+  idle_timeout time.Duration,
+  stop chan struct{}) {
   // heartbeat periodically. If the last flush was longer than
   // 'idle_timeout' time ago, then we'll force a flush to prevent us from
   // holding on to spooled events for too long.
+  // Flush early once the spooled events add up to 'max_bytes', if set, so
+  // batches of long lines don't make windows too big to send in time.
+  // Once 'stop' is closed, flush everything and close 'output'.
 
   ticker := time.NewTicker(idle_timeout / 2)
 
@@ -20,6 +25,8 @@ func Spool(input chan *FileEvent,
 
   // Current write position in the spool
   var spool_i int = 0
+  // Uncompressed bytes of the events spooled
+  var spool_bytes uint64 = 0
 
   next_flush_time := time.Now().Add(idle_timeout)
   for {
@@ -28,17 +35,19 @@ func Spool(input chan *FileEvent,
       //append(spool, event)
       spool[spool_i] = event
       spool_i++
+      spool_bytes += uint64(event.size())
 
       // Flush if full
-      if spool_i == cap(spool) {
+      if spool_i == cap(spool) || (max_bytes > 0 && spool_bytes >= max_bytes) {
         //spoolcopy := make([]*FileEvent, max_size)
         var spoolcopy []*FileEvent
         //fmt.Println(spool[0])
-        spoolcopy = append(spoolcopy, spool[:]...)
+        spoolcopy = append(spoolcopy, spool[:spool_i]...)
         output <- spoolcopy
         next_flush_time = time.Now().Add(idle_timeout)
 
         spool_i = 0
+        spool_bytes = 0
       }
     case <-ticker.C:
       //fmt.Println("tick")
@@ -54,8 +63,22 @@ func Spool(input chan *FileEvent,
           output <- spoolcopy
           next_flush_time = now.Add(idle_timeout)
           spool_i = 0
+          spool_bytes = 0
         }
       } /* if 'now' is after 'next_flush_time' */
+    case <-stop:
+      // Take what the harvesters sent before they stopped too, flush it
+      // all, and tell the publisher there is no more
+      var spoolcopy []*FileEvent
+      spoolcopy = append(spoolcopy, spool[0:spool_i]...)
+      for len(input) > 0 {
+        spoolcopy = append(spoolcopy, <-input)
+      }
+      if len(spoolcopy) > 0 {
+        output <- spoolcopy
+      }
+      close(output)
+      return
       /* case ... */
     } /* select */
   } /* for */
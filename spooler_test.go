@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSpoolMaxBytes(t *testing.T) {
+	events := makeEvents("one", "two", "three", "four")
+	maxBytes := events[0].size() + events[1].size()
+	input := make(chan *FileEvent)
+	output := make(chan []*FileEvent, 1)
+	go Spool(input, output, 100, uint64(maxBytes), time.Hour, nil)
+
+	for _, event := range events {
+		input <- event
+	}
+	select {
+	case batch := <-output:
+		if len(batch) != 2 {
+			t.Errorf("Expected a batch of 2 events once it reached %d bytes, got %d", maxBytes, len(batch))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the spool to be flushed once it reached %d bytes", maxBytes)
+	}
+}
+
+func TestEventSize(t *testing.T) {
+	event := makeEvents("hello")[0]
+	// The source, text and fields
+	if size := event.size(); size != len("/var/log/test.log")+len("hello")+len("type")+len("test") {
+		t.Errorf("Expected the size of the source, text and fields, got %d", size)
+	}
+
+	// Decoded keys count as they are sent
+	plain := event.size()
+	event.Decoded = map[string]interface{}{
+		"level":   "info",
+		"count":   json.Number("1234"),
+		"request": map[string]interface{}{"path": "/index.html"},
+	}
+	expected := plain + len("level") + len("info") + len("count") + len("1234") + len("request") + len(`{"path":"/index.html"}`)
+	if size := event.size(); size != expected {
+		t.Errorf("Expected the size to include the decoded keys, %d, got %d", expected, size)
+	}
+
+	if size := makeEvents("")[0].size(); size != 0 {
+		t.Errorf("Expected markers to take no bytes, got %d", size)
+	}
+}
+
+func TestSpoolStop(t *testing.T) {
+	input := make(chan *FileEvent, 4)
+	output := make(chan []*FileEvent, 1)
+	stop := make(chan struct{})
+	go Spool(input, output, 100, 0, time.Hour, stop)
+
+	events := makeEvents("one", "two", "three")
+	input <- events[0]
+	input <- events[1]
+	// Sent by a harvester just before it stopped
+	close(stop)
+	input <- events[2]
+
+	var flushed []*FileEvent
+	for batch := range output {
+		flushed = append(flushed, batch...)
+	}
+	if len(flushed) < 2 || flushed[0] != events[0] || flushed[1] != events[1] {
+		t.Errorf("Expected the spooled events to be flushed when stopping, got %v", flushed)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const watchEvents = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// dirWatcher uses inotify to tell the prospector when files are created,
+// moved or deleted in the directories it watches.
+type dirWatcher struct {
+	fd      int
+	file    *os.File // the non-blocking fd, so close() wakes up read()
+	changed chan bool
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &dirWatcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), changed: make(chan bool, 1)}
+	go w.read()
+	return w, nil
+}
+
+// Watch a directory. Watching a directory that is already watched is
+// harmless, so this can be called on every scan to pick up new directories
+// and directories that were recreated.
+func (w *dirWatcher) watch(dir string) error {
+	_, err := syscall.InotifyAddWatch(w.fd, dir, watchEvents)
+	return err
+}
+
+func (w *dirWatcher) close() {
+	w.file.Close()
+}
+
+func (w *dirWatcher) read() {
+	// Any event means a rescan, so don't bother decoding them
+	buffer := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buffer)
+		if err != nil || n <= 0 {
+			// The watcher was closed
+			return
+		}
+
+		// Coalesce events that arrive before the prospector gets to them
+		select {
+		case w.changed <- true:
+		default:
+		}
+	}
+}
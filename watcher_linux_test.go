@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDirWatcherSignalsCreate(t *testing.T) {
+	tmpdir := makeTempDir(t)
+	defer rmTempDir(tmpdir)
+
+	watcher, err := newDirWatcher()
+	if err != nil {
+		t.Fatalf("Error starting watcher: %s", err)
+	}
+	defer watcher.close()
+
+	chkerr(t, watcher.watch(tmpdir))
+	// Watching twice is fine
+	chkerr(t, watcher.watch(tmpdir))
+
+	chkerr(t, ioutil.WriteFile(path.Join(tmpdir, "new.log"), []byte("hello\n"), 0644))
+
+	select {
+	case <-watcher.changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the watcher to signal a change after a file was created")
+	}
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+type dirWatcher struct {
+	changed chan bool
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("inotify is not supported on this platform")
+}
+
+func (w *dirWatcher) watch(dir string) error {
+	return nil
+}
+
+func (w *dirWatcher) close() {
+}